@@ -0,0 +1,177 @@
+//go:build windows
+
+package wintray
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	// Stops the running icon animation and waits for it to end
+	stopAnimation func()
+	// Lock to protect stopAnimation
+	animationLock sync.Mutex
+	// Fully transparent icon used for flashing
+	blankIconHandle windows.Handle
+	blankIconErr    error
+	blankIconOnce   sync.Once
+)
+
+// Flash the tray icon to draw attention, alternating count times between
+// the current icon and a blank icon.
+// The current icon is restored when done, or when another animation starts.
+// Setting the icon in the meantime ends the flashing.
+// The interval must be positive.
+func FlashIcon(count int, interval time.Duration) error {
+	if count < 0 {
+		return fmt.Errorf("invalid flash count %d", count)
+	}
+	if interval <= 0 {
+		return fmt.Errorf("invalid flash interval %s", interval)
+	}
+	if !wt.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	if quitting.Load() {
+		return ErrTrayQuitting
+	}
+	blank, err := blankIcon()
+	if err != nil {
+		return fmt.Errorf("failed to create blank icon: %w", err)
+	}
+	startIconAnimation(func(stop <-chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for i := 0; i < count*2; i++ {
+			wt.muNID.Lock()
+			frame := blank
+			if i%2 == 1 {
+				frame = wt.trayIcon
+			}
+			err := wt.showIcon(frame)
+			wt.muNID.Unlock()
+			if err != nil {
+				logf("systray error: failed to show animation frame: %s\n", err)
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+	return nil
+}
+
+// Show another icon for the duration d, e.g. while saving, then restore the icon set by the application.
+// iconBytes should be the content of .ico image.
+// Calling SetIcon in the meantime ends the status icon early, and the new icon stays.
+// Starting another animation or calling Quit also restores the icon early.
+func FlashStatusIcon(iconBytes []byte, d time.Duration) error {
+	if !wt.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	if quitting.Load() {
+		return ErrTrayQuitting
+	}
+	iconFilePath, err := iconBytesToFilePath(iconBytes)
+	if err != nil {
+		return fmt.Errorf("failed to write icon data to temp file: %w", err)
+	}
+	h, err := wt.loadIconFrom(iconFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to load icon: %w", err)
+	}
+	startIconAnimation(func(stop <-chan struct{}) {
+		wt.muNID.Lock()
+		err := wt.showIcon(h)
+		wt.muNID.Unlock()
+		if err != nil {
+			logf("systray error: failed to show status icon: %s\n", err)
+			return
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-stop:
+		case <-timer.C:
+		}
+	})
+	return nil
+}
+
+// Start an animation of the tray icon on a new goroutine, stopping any running
+// animation first. run should return when stop is closed.
+// The icon set by the application is restored when the animation ends.
+func startIconAnimation(run func(stop <-chan struct{})) {
+	animationLock.Lock()
+	defer animationLock.Unlock()
+	if stopAnimation != nil {
+		stopAnimation()
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var stopOnce sync.Once
+	stopAnimation = func() {
+		stopOnce.Do(func() { close(stop) })
+		<-done
+	}
+	go func() {
+		defer close(done)
+		run(stop)
+		wt.muNID.Lock()
+		err := wt.showIcon(wt.trayIcon)
+		wt.muNID.Unlock()
+		if err != nil {
+			logf("systray error: failed to restore icon after animation: %s\n", err)
+		}
+	}()
+}
+
+// Stop the running icon animation, if any.
+func stopIconAnimation() {
+	animationLock.Lock()
+	defer animationLock.Unlock()
+	if stopAnimation != nil {
+		stopAnimation()
+		stopAnimation = nil
+	}
+}
+
+// Return a fully transparent icon of the small icon size.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-createicon
+func blankIcon() (windows.Handle, error) {
+	blankIconOnce.Do(func() {
+		const SM_CXSMICON = 49
+		const SM_CYSMICON = 50
+		cx, _, _ := pGetSystemMetrics.Call(SM_CXSMICON)
+		cy, _, _ := pGetSystemMetrics.Call(SM_CYSMICON)
+		// Monochrome rows are padded to 16 bits
+		stride := (cx + 15) / 16 * 2
+		andBits := make([]byte, stride*cy)
+		for i := range andBits {
+			andBits[i] = 0xFF // transparent
+		}
+		xorBits := make([]byte, stride*cy)
+		res, _, err := pCreateIcon.Call(
+			uintptr(wt.instance),
+			cx,
+			cy,
+			1,
+			1,
+			uintptr(unsafe.Pointer(&andBits[0])),
+			uintptr(unsafe.Pointer(&xorBits[0])),
+		)
+		if res == 0 {
+			blankIconErr = err
+			return
+		}
+		blankIconHandle = windows.Handle(res)
+	})
+	return blankIconHandle, blankIconErr
+}
@@ -0,0 +1,46 @@
+//go:build windows
+
+package wintray
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlashIconInvalidArguments(t *testing.T) {
+	if err := FlashIcon(-1, time.Millisecond); err == nil {
+		t.Error("no error for a negative count")
+	}
+	if err := FlashIcon(3, 0); err == nil {
+		t.Error("no error for a zero interval")
+	}
+	if err := FlashIcon(3, -time.Second); err == nil {
+		t.Error("no error for a negative interval")
+	}
+	if err := FlashIcon(1, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	stopIconAnimation()
+}
+
+func TestSetIconEndsStatusIcon(t *testing.T) {
+	if err := FlashStatusIcon(testIcon(16, 0xFFFF0000), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetIcon(testIcon(16, 0xFF00FF00)); err != nil {
+		t.Fatal(err)
+	}
+	animationLock.Lock()
+	running := stopAnimation != nil
+	animationLock.Unlock()
+	if running {
+		t.Error("status icon still shown after SetIcon")
+	}
+	// The new icon stays
+	wt.muNID.RLock()
+	shown, trayIcon := wt.nid.Icon, wt.trayIcon
+	wt.muNID.RUnlock()
+	if shown != trayIcon {
+		t.Errorf("tray shows icon %d, want the new icon %d", shown, trayIcon)
+	}
+}
@@ -0,0 +1,203 @@
+//go:build windows
+
+package wintray
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Set whether or not the menu item shows a small dot, e.g. to indicate unread updates.
+// The dot is drawn on the item's icon, or on its own if the item has no icon.
+func (item *MenuItem) SetBadge(badge bool) error {
+	item.mu.Lock()
+	item.badge = badge
+	item.mu.Unlock()
+	return item.applyBitmap()
+}
+
+// Return whether the menu item shows a badge.
+func (item *MenuItem) Badge() bool {
+	item.mu.RLock()
+	defer item.mu.RUnlock()
+	return item.badge
+}
+
+// Set the bitmap of the menu item's icon and update the menu item.
+// source draws the bitmap again when the size of menu icons changes.
+func (item *MenuItem) setIconBitmap(h windows.Handle, source func() (windows.Handle, error)) error {
+	item.mu.Lock()
+	item.icon = h
+	item.iconSource = source
+	item.mu.Unlock()
+	return item.applyBitmap()
+}
+
+// Delete the bitmaps of the menu item's icon, once the item is gone for good.
+func (item *MenuItem) freeIcons() {
+	item.mu.Lock()
+	icon, badgeIcon := item.icon, item.badgeIcon
+	item.icon, item.badgeIcon, item.iconSource = 0, 0, nil
+	item.mu.Unlock()
+	if icon != 0 {
+		pDeleteObject.Call(uintptr(icon))
+	}
+	if badgeIcon != 0 {
+		pDeleteObject.Call(uintptr(badgeIcon))
+	}
+}
+
+// Draw the icons of the menu items again if the size of menu icons changed,
+// e.g. after the text size was changed in the settings.
+// Must be called on the message loop thread.
+func (t *winTray) refreshMenuItemIcons() {
+	size := menuIconSize()
+	if size == t.menuIconSize {
+		return
+	}
+	t.menuIconSize = size
+
+	menuItemsLock.RLock()
+	items := make([]*MenuItem, 0, len(menuItems))
+	for _, item := range menuItems {
+		items = append(items, item)
+	}
+	menuItemsLock.RUnlock()
+	for _, item := range items {
+		item.mu.RLock()
+		source, oldIcon := item.iconSource, item.icon
+		item.mu.RUnlock()
+		if source == nil {
+			continue
+		}
+		h, err := source()
+		if err != nil {
+			logf("systray error: failed to redraw menu item icon: %s\n", err)
+			continue
+		}
+		item.mu.Lock()
+		item.icon = h
+		item.mu.Unlock()
+		if err := item.applyBitmap(); err != nil {
+			logf("systray error: %s\n", err)
+		}
+		if oldIcon != 0 {
+			pDeleteObject.Call(uintptr(oldIcon))
+		}
+	}
+}
+
+// Return the size of menu item icons.
+func menuIconSize() Point {
+	const SM_CXSMICON = 49
+	const SM_CYSMICON = 50
+	cx, _, _ := pGetSystemMetrics.Call(SM_CXSMICON)
+	cy, _, _ := pGetSystemMetrics.Call(SM_CYSMICON)
+	return Point{X: int32(cx), Y: int32(cy)}
+}
+
+// Store the bitmap to show on the menu item, drawing the badge if needed,
+// and update the menu item.
+func (item *MenuItem) applyBitmap() error {
+	if !wt.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	item.mu.Lock()
+	h := item.icon
+	if item.badge {
+		b, err := badgeBitmap(h)
+		if err != nil {
+			item.mu.Unlock()
+			return fmt.Errorf("failed to draw badge: %w", err)
+		}
+		h = b
+	}
+	oldBadgeIcon := item.badgeIcon
+	if item.badge {
+		item.badgeIcon = h
+	} else {
+		item.badgeIcon = 0
+	}
+	item.mu.Unlock()
+
+	wt.muMenuItemIcons.Lock()
+	if h == 0 {
+		delete(wt.menuItemIcons, item.id)
+	} else {
+		wt.menuItemIcons[item.id] = h
+	}
+	wt.muMenuItemIcons.Unlock()
+
+	err := item.apply()
+	if oldBadgeIcon != 0 {
+		pDeleteObject.Call(uintptr(oldBadgeIcon))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update menu item: %w", err)
+	}
+	return nil
+}
+
+// Draw a notification dot in the top right corner of a copy of a menu item bitmap.
+// If base is 0, the dot is drawn on a transparent bitmap.
+func badgeBitmap(base windows.Handle) (windows.Handle, error) {
+	const SM_CXSMICON = 49
+	const SM_CYSMICON = 50
+	const SRCCOPY = 0x00CC0020
+	// Premultiplied BGRA
+	const badgeColor = 0xFFE81123
+
+	hDC, _, err := pGetDC.Call(uintptr(0))
+	if hDC == 0 {
+		return 0, err
+	}
+	defer pReleaseDC.Call(uintptr(0), hDC)
+	hMemDC, _, err := pCreateCompatibleDC.Call(hDC)
+	if hMemDC == 0 {
+		return 0, err
+	}
+	defer pDeleteDC.Call(hMemDC)
+	cx, _, _ := pGetSystemMetrics.Call(SM_CXSMICON)
+	cy, _, _ := pGetSystemMetrics.Call(SM_CYSMICON)
+	hMemBmp, bits, err := create32BitHBitmap(hMemDC, int32(cx), int32(cy))
+	if err != nil {
+		return 0, err
+	}
+
+	if base != 0 {
+		hSrcDC, _, err := pCreateCompatibleDC.Call(hDC)
+		if hSrcDC == 0 {
+			pDeleteObject.Call(hMemBmp)
+			return 0, err
+		}
+		hOriginalSrc, _, _ := pSelectObject.Call(hSrcDC, uintptr(base))
+		hOriginalBmp, _, _ := pSelectObject.Call(hMemDC, hMemBmp)
+		res, _, err := pBitBlt.Call(hMemDC, 0, 0, cx, cy, hSrcDC, 0, 0, SRCCOPY)
+		pSelectObject.Call(hMemDC, hOriginalBmp)
+		pSelectObject.Call(hSrcDC, hOriginalSrc)
+		pDeleteDC.Call(hSrcDC)
+		if res == 0 {
+			pDeleteObject.Call(hMemBmp)
+			return 0, err
+		}
+	}
+	// Make sure GDI is done with the bitmap before touching its pixels
+	pGdiFlush.Call()
+
+	w, h := int(cx), int(cy)
+	pixels := unsafe.Slice((*uint32)(bits), w*h)
+	r := w * 3 / 10
+	centerX, centerY := w-r-1, r
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := x-centerX, y-centerY
+			if dx*dx+dy*dy <= r*r {
+				// Rows are stored bottom-up
+				pixels[(h-1-y)*w+x] = badgeColor
+			}
+		}
+	}
+	return windows.Handle(hMemBmp), nil
+}
@@ -0,0 +1,131 @@
+//go:build windows
+
+package wintray
+
+// ClickButton identifies a way of clicking the tray icon.
+type ClickButton int
+
+const (
+	ClickLeft ClickButton = iota
+	ClickRight
+	ClickMiddle
+	ClickDouble
+	numClickButtons
+)
+
+// Kinds of ClickAction
+type clickActionKind int
+
+const (
+	clickDefault clickActionKind = iota
+	clickNone
+	clickOpenMenu
+	clickQuit
+	clickFunc
+)
+
+// ClickAction is what happens when the tray icon is clicked, see SetClickAction.
+type ClickAction struct {
+	kind clickActionKind
+	f    func()
+}
+
+var (
+	// Follow SetOpenOnLeftClick, SetOpenOnRightClick and OnRightClick,
+	// and ignore middle and double clicks
+	ClickActionDefault = ClickAction{kind: clickDefault}
+	// Ignore the click
+	ClickActionNone = ClickAction{kind: clickNone}
+	// Open the menu
+	ClickActionOpenMenu = ClickAction{kind: clickOpenMenu}
+	// Quit the systray, like Quit
+	ClickActionQuit = ClickAction{kind: clickQuit}
+)
+
+// Return an action that calls f from a new goroutine.
+func ClickActionFunc(f func()) ClickAction {
+	return ClickAction{kind: clickFunc, f: f}
+}
+
+// Sent with NOTIFYICON_VERSION_4 when the focused icon is activated with Enter or Space.
+// https://learn.microsoft.com/en-us/windows/win32/api/shellapi/nf-shellapi-shell_notifyiconw#remarks
+const NIN_KEYSELECT = 0x0401 // NIN_SELECT | NINF_KEY, i.e. WM_USER + 1
+
+// Actions of the click buttons, protected by callbacksLock
+var clickActions [numClickButtons]ClickAction
+
+// Set what happens when the tray icon is clicked with the given button.
+// A double click is also reported as a left click.
+func SetClickAction(button ClickButton, action ClickAction) {
+	if button < 0 || button >= numClickButtons {
+		return
+	}
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	clickActions[button] = action
+}
+
+// Quit the systray when the tray icon is clicked with the middle button.
+func QuitOnMiddleClick() {
+	SetClickAction(ClickMiddle, ClickActionQuit)
+}
+
+// Perform the action of a click on the tray icon and return whether to open the menu.
+func (t *winTray) handleClick(event uintptr) (openMenu bool) {
+	const (
+		WM_LBUTTONUP     = 0x0202
+		WM_LBUTTONDBLCLK = 0x0203
+		WM_MBUTTONUP     = 0x0208
+		WM_CONTEXTMENU   = 0x007B
+	)
+	var button ClickButton
+	switch event {
+	case WM_LBUTTONUP, NIN_KEYSELECT:
+		// Enter or Space on the focused icon acts like a left click
+		button = ClickLeft
+	case WM_CONTEXTMENU:
+		// With NOTIFYICON_VERSION_4, it follows WM_RBUTTONUP for a right click,
+		// and is also sent for Shift+F10 or the menu key on the focused icon
+		button = ClickRight
+	case WM_MBUTTONUP:
+		button = ClickMiddle
+	case WM_LBUTTONDBLCLK:
+		button = ClickDouble
+	default:
+		return false
+	}
+	callbacksLock.RLock()
+	action := clickActions[button]
+	callbacksLock.RUnlock()
+
+	switch action.kind {
+	case clickOpenMenu:
+		return true
+	case clickQuit:
+		Quit()
+	case clickFunc:
+		if action.f != nil {
+			go action.f()
+		}
+	case clickDefault:
+		switch button {
+		case ClickRight:
+			openMenu = openOnRightClick.Load()
+			callbacksLock.RLock()
+			f := rightClickCallback
+			callbacksLock.RUnlock()
+			if f != nil {
+				openMenu = f()
+			}
+		case ClickLeft:
+			openMenu = openOnLeftClick.Load()
+			callbacksLock.RLock()
+			f := leftClickCallback
+			callbacksLock.RUnlock()
+			if f != nil {
+				openMenu = f()
+			}
+		}
+	}
+	return openMenu
+}
@@ -0,0 +1,191 @@
+//go:build windows
+
+package wintray
+
+import (
+	"sync"
+	"testing"
+)
+
+// Click the tray icon with a synthesized message and return whether the menu was opened.
+func clickIcon(t *testing.T, event uintptr) (opened bool) {
+	t.Helper()
+	id := OnTrayOpened(func() { opened = true })
+	defer RemoveTrayOpenedCallback(id)
+	injectMessage(t, wt.wmSystrayMessage, 0, iconEvent(event))
+	return opened
+}
+
+func TestOpenOnLeftClick(t *testing.T) {
+	const WM_LBUTTONUP = 0x0202
+	defer SetOpenOnLeftClick(true)
+
+	SetOpenOnLeftClick(false)
+	if clickIcon(t, WM_LBUTTONUP) {
+		t.Error("left click opened the menu with SetOpenOnLeftClick(false)")
+	}
+	SetOpenOnLeftClick(true)
+	if !clickIcon(t, WM_LBUTTONUP) {
+		t.Error("left click didn't open the menu with SetOpenOnLeftClick(true)")
+	}
+}
+
+func TestLeftClickHandler(t *testing.T) {
+	const WM_LBUTTONUP = 0x0202
+	defer SetLeftClickHandler(nil)
+
+	called := false
+	SetLeftClickHandler(func() bool {
+		called = true
+		return false
+	})
+	if clickIcon(t, WM_LBUTTONUP) {
+		t.Error("left click opened the menu although the handler returned false")
+	}
+	if !called {
+		t.Error("left click handler wasn't called")
+	}
+}
+
+func TestClickActionFunc(t *testing.T) {
+	const WM_MBUTTONUP = 0x0208
+	defer SetClickAction(ClickMiddle, ClickActionDefault)
+
+	clicked := make(chan struct{}, 1)
+	SetClickAction(ClickMiddle, ClickActionFunc(func() { clicked <- struct{}{} }))
+	if clickIcon(t, WM_MBUTTONUP) {
+		t.Error("middle click opened the menu")
+	}
+	receive(t, clicked, "middle click action")
+
+	SetClickAction(ClickMiddle, ClickActionOpenMenu)
+	if !clickIcon(t, WM_MBUTTONUP) {
+		t.Error("middle click didn't open the menu with ClickActionOpenMenu")
+	}
+}
+
+func TestClicksIgnored(t *testing.T) {
+	const WM_LBUTTONUP = 0x0202
+
+	// Messages about other icons of the window aren't for us
+	opened := false
+	id := OnTrayOpened(func() { opened = true })
+	injectMessage(t, wt.wmSystrayMessage, 0, WM_LBUTTONUP|uintptr(iconID.Load()+1)<<16)
+	RemoveTrayOpenedCallback(id)
+	if opened {
+		t.Error("click on another icon opened the menu")
+	}
+
+	SetInteractive(false)
+	defer SetInteractive(true)
+	if clickIcon(t, WM_LBUTTONUP) {
+		t.Error("click opened the menu while not interactive")
+	}
+}
+
+func TestClickSettingsWhileDispatching(t *testing.T) {
+	const WM_LBUTTONUP = 0x0202
+	defer SetOpenOnLeftClick(true)
+	defer SetOpenOnRightClick(true)
+
+	// Run with -race to catch unsynchronized access from the message loop
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id := OnTrayOpened(func() {})
+			SetOpenOnLeftClick(i%2 == 0)
+			SetOpenOnRightClick(i%2 != 0)
+			RemoveTrayOpenedCallback(id)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		injectMessage(t, wt.wmSystrayMessage, 0, iconEvent(WM_LBUTTONUP))
+	}
+	close(stop)
+	wg.Wait()
+
+	SetOpenOnLeftClick(true)
+	if !clickIcon(t, WM_LBUTTONUP) {
+		t.Error("left click didn't open the menu after the changes")
+	}
+}
+
+func TestRightClickHandledOnce(t *testing.T) {
+	const (
+		WM_RBUTTONUP   = 0x0205
+		WM_CONTEXTMENU = 0x007B
+	)
+	clicks := 0
+	OnRightClick(func() bool {
+		clicks++
+		return false
+	})
+	defer OnRightClick(nil)
+
+	// With NOTIFYICON_VERSION_4, a right click sends both messages
+	injectMessage(t, wt.wmSystrayMessage, 0, iconEvent(WM_RBUTTONUP))
+	injectMessage(t, wt.wmSystrayMessage, 0, iconEvent(WM_CONTEXTMENU))
+	if clicks != 1 {
+		t.Errorf("right click handled %d times, want once", clicks)
+	}
+
+	// The menu key sends WM_CONTEXTMENU alone
+	injectMessage(t, wt.wmSystrayMessage, 0, iconEvent(WM_CONTEXTMENU))
+	if clicks != 2 {
+		t.Errorf("menu key handled %d times, want once", clicks-1)
+	}
+}
+
+func TestRightClickOpensMenuAtCursor(t *testing.T) {
+	const (
+		WM_RBUTTONUP   = 0x0205
+		WM_CONTEXTMENU = 0x007B
+		NIM_SETFOCUS   = 0x00000003
+	)
+	// Only the keyboard gives the focus back to the notification area
+	resetHeadlessHistory()
+	injectMessage(t, wt.wmSystrayMessage, 0, iconEvent(WM_RBUTTONUP))
+	if !clickIcon(t, WM_CONTEXTMENU) {
+		t.Fatal("right click didn't open the menu")
+	}
+	if n := notifyIconCalls(NIM_SETFOCUS); n != 0 {
+		t.Errorf("mouse right click set the focus %d times", n)
+	}
+	if !clickIcon(t, WM_CONTEXTMENU) {
+		t.Fatal("menu key didn't open the menu")
+	}
+	if n := notifyIconCalls(NIM_SETFOCUS); n != 1 {
+		t.Errorf("menu key set the focus %d times, want once", n)
+	}
+}
+
+func TestKeyboardActivation(t *testing.T) {
+	const (
+		NIN_BALLOONHIDE = 0x0403 // WM_USER + 3
+		NIM_SETFOCUS    = 0x00000003
+	)
+	// Hiding a notification balloon isn't a click
+	resetHeadlessHistory()
+	if clickIcon(t, NIN_BALLOONHIDE) {
+		t.Error("hidden balloon opened the menu")
+	}
+	if n := notifyIconCalls(NIM_SETFOCUS); n != 0 {
+		t.Errorf("hidden balloon set the focus %d times", n)
+	}
+
+	// Enter or Space on the focused icon acts like a left click
+	if !clickIcon(t, NIN_KEYSELECT) {
+		t.Fatal("keyboard activation didn't open the menu")
+	}
+	if n := notifyIconCalls(NIM_SETFOCUS); n != 1 {
+		t.Errorf("keyboard activation set the focus %d times, want once", n)
+	}
+}
@@ -0,0 +1,134 @@
+//go:build windows
+
+package wintray
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	// Callbacks called when the clipboard changes, protected by callbacksLock
+	clipboardListeners []func()
+	// Whether or not the tray window receives clipboard updates; only used on the message loop thread
+	clipboardListening bool
+)
+
+// Add a callback to be called when the content of the clipboard changes,
+// e.g. for a clipboard manager. The callback runs on a new goroutine.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-addclipboardformatlistener
+func AddClipboardListener(f func()) error {
+	return wt.runOnLoop(func() error {
+		if !clipboardListening {
+			res, _, err := pAddClipboardFormatListener.Call(uintptr(wt.window))
+			if res == 0 {
+				return fmt.Errorf("failed to listen to the clipboard: %w", err)
+			}
+			clipboardListening = true
+		}
+		callbacksLock.Lock()
+		clipboardListeners = append(clipboardListeners, f)
+		callbacksLock.Unlock()
+		return nil
+	})
+}
+
+// Stop receiving clipboard updates. Must be called on the message loop thread.
+func (t *winTray) removeClipboardListener() {
+	if clipboardListening {
+		pRemoveClipboardFormatListener.Call(uintptr(t.window))
+		clipboardListening = false
+	}
+}
+
+// Handle a WM_CLIPBOARDUPDATE message.
+func (t *winTray) handleClipboardUpdate() {
+	callbacksLock.RLock()
+	listeners := clipboardListeners
+	callbacksLock.RUnlock()
+	for _, f := range listeners {
+		go f()
+	}
+}
+
+// Add a menu item that copies text to the clipboard when clicked,
+// e.g. to copy an address or a token.
+func AddMenuItemCopy(title, text string) *MenuItem {
+	item := AddMenuItem(title)
+	item.SetCallback(func() {
+		if err := copyToClipboard(text); err != nil {
+			logf("systray error: failed to copy to clipboard: %s\n", err)
+		}
+	})
+	return item
+}
+
+// Replace the content of the clipboard with text.
+// The clipboard is opened on the message loop thread, since it stays open
+// for the thread that opened it until it's closed.
+func copyToClipboard(text string) error {
+	data, err := windows.UTF16FromString(text)
+	if err != nil {
+		return err
+	}
+	return wt.runOnLoop(func() error { return setClipboardText(data) })
+}
+
+// Replace the content of the clipboard with the UTF-16 text in data, including its terminating null.
+// Must be called on the message loop thread.
+// Using the Clipboard: https://learn.microsoft.com/en-us/windows/win32/dataxchg/using-the-clipboard
+func setClipboardText(data []uint16) error {
+	const (
+		CF_UNICODETEXT = 13
+		GMEM_MOVEABLE  = 0x0002
+	)
+	size := uintptr(len(data)) * unsafe.Sizeof(data[0])
+
+	if err := openClipboard(); err != nil {
+		return fmt.Errorf("failed to open clipboard: %w", err)
+	}
+	defer pCloseClipboard.Call()
+	res, _, err := pEmptyClipboard.Call()
+	if res == 0 {
+		return fmt.Errorf("failed to empty clipboard: %w", err)
+	}
+
+	hMem, _, err := pGlobalAlloc.Call(GMEM_MOVEABLE, size)
+	if hMem == 0 {
+		return fmt.Errorf("failed to allocate memory: %w", err)
+	}
+	ptr, _, err := pGlobalLock.Call(hMem)
+	if ptr == 0 {
+		pGlobalFree.Call(hMem)
+		return fmt.Errorf("failed to lock memory: %w", err)
+	}
+	pRtlMoveMemory.Call(ptr, uintptr(unsafe.Pointer(&data[0])), size)
+	pGlobalUnlock.Call(hMem)
+
+	res, _, err = pSetClipboardData.Call(CF_UNICODETEXT, hMem)
+	if res == 0 {
+		// The memory is only owned by the system if the call succeeds
+		pGlobalFree.Call(hMem)
+		return fmt.Errorf("failed to set clipboard data: %w", err)
+	}
+	return nil
+}
+
+// Open the clipboard, retrying briefly since another application may be holding it.
+// The tray window is set as the clipboard owner if it exists.
+// OpenClipboard: https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-openclipboard
+func openClipboard() error {
+	var err error
+	for i := 0; i < 10; i++ {
+		var res uintptr
+		res, _, err = pOpenClipboard.Call(uintptr(wt.window))
+		if res != 0 {
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+//go:build windows
+
+package wintray
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// Logger used for errors that can't be returned, or nil to use the standard logger
+var logger atomic.Pointer[log.Logger]
+
+// Config gathers the settings applied by RunWith and RegisterWith.
+// They are all applied before the tray icon is created, so there's no need
+// to call the individual setters at the right moment.
+type Config struct {
+	// Icon, tooltip and visibility of the tray icon
+	Options
+	// Title of the hidden window owning the tray icon, to help identify the app
+	AppName string
+	// Window class name of the hidden window; defaults to "SystrayClass"
+	ClassName string
+	// Don't open the menu on left click, see SetOpenOnLeftClick
+	NoMenuOnLeftClick bool
+	// Don't open the menu on right click, see SetOpenOnRightClick
+	NoMenuOnRightClick bool
+	// Run onReady on the goroutine calling RunWith or RegisterWith before it returns,
+	// instead of on a new goroutine
+	SyncOnReady bool
+	// Callback to be called when the tray is opened, see OnTrayOpened
+	OnTrayOpened func()
+	// Logger for errors that can't be returned, see SetLogger
+	Logger *log.Logger
+}
+
+// Like Run, but applies the settings in cfg first.
+// The click settings of cfg replace those set with SetOpenOnLeftClick and SetOpenOnRightClick.
+func RunWith(cfg Config, onReady, onExit func()) error {
+	err := RegisterWith(cfg, onReady, onExit)
+	if err != nil {
+		return err
+	}
+	nativeLoop()
+	return nil
+}
+
+// Like Register, but applies the settings in cfg first.
+// The click settings of cfg replace those set with SetOpenOnLeftClick and SetOpenOnRightClick.
+func RegisterWith(cfg Config, onReady, onExit func()) error {
+	SetOpenOnLeftClick(!cfg.NoMenuOnLeftClick)
+	SetOpenOnRightClick(!cfg.NoMenuOnRightClick)
+	if cfg.OnTrayOpened != nil {
+		OnTrayOpened(cfg.OnTrayOpened)
+	}
+	if cfg.Logger != nil {
+		SetLogger(cfg.Logger)
+	}
+	return register(onReady, onExit, cfg)
+}
+
+// Set the logger used for errors that can't be returned to the caller.
+// Pass nil to go back to the standard logger.
+func SetLogger(l *log.Logger) {
+	logger.Store(l)
+}
+
+// Log an error with the configured logger.
+func logf(format string, v ...any) {
+	if l := logger.Load(); l != nil {
+		l.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,75 @@
+//go:build windows
+
+package wintray
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Show the menu item grayed out while still calling its callback when clicked.
+// Windows doesn't allow choosing grayed items, so clicks on them are caught
+// while the menu is open. Has no effect while the item is disabled.
+func (item *MenuItem) SetGrayedWithoutDisabling(grayed bool) {
+	item.mu.Lock()
+	item.grayed = grayed
+	item.mu.Unlock()
+	item.update()
+}
+
+// Return whether the menu item is grayed out without being disabled.
+func (item *MenuItem) GrayedWithoutDisabling() bool {
+	item.mu.RLock()
+	defer item.mu.RUnlock()
+	return item.grayed && !item.disabled
+}
+
+// Called by the system for messages of the menu's modal loop.
+// https://learn.microsoft.com/en-us/windows/win32/winmsg/messageproc
+var menuMsgFilterProc = windows.NewCallback(func(code int32, wParam uintptr, lParam *msg) uintptr {
+	const (
+		MSGF_MENU    = 2
+		WM_KEYDOWN   = 0x0100
+		WM_LBUTTONUP = 0x0202
+		VK_RETURN    = 0x0D
+	)
+	if code == MSGF_MENU && wt.hotItem != 0 &&
+		(lParam.Message == WM_LBUTTONUP || lParam.Message == WM_KEYDOWN && lParam.Wparam == VK_RETURN) {
+		menuItemsLock.RLock()
+		item, ok := menuItems[wt.hotItem]
+		menuItemsLock.RUnlock()
+		if ok && item.GrayedWithoutDisabling() {
+			// Close the menu and call the callback once TrackPopupMenu returns
+			const WM_CANCELMODE = 0x001F
+			wt.grayedClick = wt.hotItem
+			pPostMessage.Call(uintptr(wt.window), WM_CANCELMODE, 0, 0)
+			return 1
+		}
+	}
+	res, _, _ := pCallNextHookEx.Call(0, uintptr(code), wParam, uintptr(unsafe.Pointer(lParam)))
+	return res
+})
+
+// Start catching clicks on grayed items, returning a function to stop it.
+// Must be called on the message loop thread.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-setwindowshookexw
+func (t *winTray) hookGrayedClicks() func() {
+	const WH_MSGFILTER = -1
+	t.hotItem = 0
+	t.grayedClick = 0
+	whMsgFilter := int32(WH_MSGFILTER)
+	hook, _, err := pSetWindowsHookEx.Call(
+		uintptr(whMsgFilter),
+		menuMsgFilterProc,
+		0,
+		uintptr(t.threadID),
+	)
+	if hook == 0 {
+		logf("systray error: failed to hook menu messages: %s\n", err)
+		return func() {}
+	}
+	return func() {
+		pUnhookWindowsHookEx.Call(hook)
+	}
+}
@@ -0,0 +1,52 @@
+//go:build windows
+
+package wintray
+
+import "testing"
+
+func TestMenuItemDisabledState(t *testing.T) {
+	const MFS_DISABLED = 0x00000003 // same as MFS_GRAYED
+	root := resetMenu(t)
+	item := AddMenuItem("Item")
+
+	item.Disable()
+	if state := testMenus.item(t, root, item.id).State; state&MFS_DISABLED != MFS_DISABLED {
+		t.Errorf("disabled item has state %#x, want the grayed bits %#x", state, MFS_DISABLED)
+	}
+	item.Enable()
+	if state := testMenus.item(t, root, item.id).State; state&MFS_DISABLED != 0 {
+		t.Errorf("enabled item has state %#x", state)
+	}
+}
+
+func TestGrayedWithoutDisabling(t *testing.T) {
+	const MFS_DISABLED = 0x00000003
+	root := resetMenu(t)
+	item := AddMenuItem("Item")
+	clicked := make(chan struct{}, 1)
+	item.SetCallback(func() { clicked <- struct{}{} })
+
+	item.SetGrayedWithoutDisabling(true)
+	if state := testMenus.item(t, root, item.id).State; state&MFS_DISABLED != MFS_DISABLED {
+		t.Errorf("grayed item has state %#x, want the grayed bits %#x", state, MFS_DISABLED)
+	}
+	if item.Disabled() || !item.GrayedWithoutDisabling() {
+		t.Error("grayed item reported as disabled")
+	}
+	item.Click()
+	receive(t, clicked, "callback of the grayed item")
+
+	// A disabled item isn't clickable, grayed or not
+	item.Disable()
+	if item.GrayedWithoutDisabling() {
+		t.Error("disabled item reported as grayed without disabling")
+	}
+	item.Click()
+	expectNothing(t, clicked, "callback call of the disabled item")
+
+	item.Enable()
+	item.SetGrayedWithoutDisabling(false)
+	if state := testMenus.item(t, root, item.id).State; state&MFS_DISABLED != 0 {
+		t.Errorf("item has state %#x after ungraying", state)
+	}
+}
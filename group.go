@@ -0,0 +1,71 @@
+//go:build windows
+
+package wintray
+
+import "sync"
+
+// MenuGroup is a set of radio menu items of which at most one is checked,
+// such as a choice between several options.
+// Don't create it directly, use NewMenuGroup()
+type MenuGroup struct {
+	mu sync.Mutex
+	// Menu items of the group, in the order they were added
+	items []*MenuItem
+	// Checked menu item, or nil if none is
+	selected *MenuItem
+}
+
+// Create an empty MenuGroup.
+func NewMenuGroup() *MenuGroup {
+	return &MenuGroup{}
+}
+
+// Add a radio item to the menu as part of the group.
+// Clicking it selects it, then the callback is called from a new goroutine.
+func (g *MenuGroup) AddItem(title string, cb func()) *MenuItem {
+	return g.add(AddMenuItem(title), cb)
+}
+
+// Add a radio item to the submenu of parent as part of the group.
+// Clicking it selects it, then the callback is called from a new goroutine.
+func (g *MenuGroup) AddSubItem(parent *MenuItem, title string, cb func()) *MenuItem {
+	return g.add(parent.AddSubMenuItem(title), cb)
+}
+
+// Make item a radio item of the group.
+func (g *MenuGroup) add(item *MenuItem, cb func()) *MenuItem {
+	item.SetRadio(true)
+	item.SetCallback(func() {
+		g.Select(item)
+		if cb != nil {
+			cb()
+		}
+	})
+	g.mu.Lock()
+	g.items = append(g.items, item)
+	g.mu.Unlock()
+	return item
+}
+
+// Check item and uncheck the other items of the group.
+// Pass nil to uncheck all items.
+func (g *MenuGroup) Select(item *MenuItem) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, other := range g.items {
+		if other != item {
+			other.Uncheck()
+		}
+	}
+	if item != nil {
+		item.Check()
+	}
+	g.selected = item
+}
+
+// Return the checked item of the group, or nil if none is.
+func (g *MenuGroup) Selected() *MenuItem {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.selected
+}
@@ -0,0 +1,118 @@
+//go:build windows
+
+package wintray
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	// Whether or not the notification area and menu functions are stubbed out
+	headless atomic.Bool
+	// Calls recorded in headless mode, at most maxHeadlessCalls
+	headlessCalls []headlessCall
+	// Lock to protect headlessCalls
+	headlessCallsLock sync.Mutex
+)
+
+// Run without a notification area, e.g. to exercise code using the package in tests on CI.
+// The hidden window and the message loop still work, but the icon isn't added
+// to the notification area and no real menus are created: those calls are recorded instead.
+// It must be called before Register.
+func SetHeadless(enabled bool) error {
+	if wt.isReady() {
+		return errors.New("headless mode must be set before Register")
+	}
+	headless.Store(enabled)
+	if enabled {
+		wt.api = &headlessMenuAPI{}
+	} else {
+		wt.api = win32MenuAPI{}
+	}
+	return nil
+}
+
+// A Win32 call that was recorded instead of being made in headless mode.
+type headlessCall struct {
+	// Name of the Win32 function
+	Name string
+	// Menu the call applies to, if any
+	Menu windows.Handle
+	// ID of the menu item, or the message of Shell_NotifyIcon
+	ID uint32
+}
+
+// Maximum number of calls kept in headless mode, so that the history doesn't grow
+// for as long as the process runs
+const maxHeadlessCalls = 1000
+
+// Record a call made in headless mode, dropping the oldest calls if there are too many.
+func recordHeadless(name string, menu windows.Handle, id uint32) {
+	headlessCallsLock.Lock()
+	defer headlessCallsLock.Unlock()
+	if len(headlessCalls) == maxHeadlessCalls {
+		// Drop the older half at once rather than shifting the calls every time
+		n := copy(headlessCalls, headlessCalls[maxHeadlessCalls/2:])
+		headlessCalls = headlessCalls[:n]
+	}
+	headlessCalls = append(headlessCalls, headlessCall{Name: name, Menu: menu, ID: id})
+}
+
+// Return the calls recorded in headless mode so far.
+func headlessHistory() []headlessCall {
+	headlessCallsLock.Lock()
+	defer headlessCallsLock.Unlock()
+	return append([]headlessCall(nil), headlessCalls...)
+}
+
+// headlessMenuAPI implements menuAPI by recording the calls,
+// handing out fake handles for the menus.
+type headlessMenuAPI struct {
+	lastMenu atomic.Uintptr
+}
+
+func (a *headlessMenuAPI) CreateMenu() (windows.Handle, error) {
+	menu := windows.Handle(a.lastMenu.Add(1))
+	recordHeadless("CreateMenu", menu, 0)
+	return menu, nil
+}
+
+func (a *headlessMenuAPI) CreatePopupMenu() (windows.Handle, error) {
+	menu := windows.Handle(a.lastMenu.Add(1))
+	recordHeadless("CreatePopupMenu", menu, 0)
+	return menu, nil
+}
+
+func (a *headlessMenuAPI) DestroyMenu(menu windows.Handle) error {
+	recordHeadless("DestroyMenu", menu, 0)
+	return nil
+}
+
+func (a *headlessMenuAPI) SetMenuInfo(menu windows.Handle, mi *menuInfo) error {
+	recordHeadless("SetMenuInfo", menu, 0)
+	return nil
+}
+
+func (a *headlessMenuAPI) InsertMenuItem(menu windows.Handle, position int, mi *menuItemInfo) error {
+	recordHeadless("InsertMenuItem", menu, mi.ID)
+	return nil
+}
+
+func (a *headlessMenuAPI) SetMenuItemInfo(menu windows.Handle, id uint32, mi *menuItemInfo) error {
+	recordHeadless("SetMenuItemInfo", menu, id)
+	return nil
+}
+
+func (a *headlessMenuAPI) DeleteMenu(menu windows.Handle, id uint32) error {
+	recordHeadless("DeleteMenu", menu, id)
+	return nil
+}
+
+func (a *headlessMenuAPI) RemoveMenu(menu windows.Handle, id uint32) error {
+	recordHeadless("RemoveMenu", menu, id)
+	return nil
+}
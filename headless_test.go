@@ -0,0 +1,59 @@
+//go:build windows
+
+package wintray
+
+import "testing"
+
+// Forget the calls recorded so far, so that a test only sees its own calls.
+func resetHeadlessHistory() {
+	headlessCallsLock.Lock()
+	defer headlessCallsLock.Unlock()
+	headlessCalls = nil
+}
+
+// Return how many times Shell_NotifyIcon was called with the message since the history was reset.
+func notifyIconCalls(message uint32) int {
+	n := 0
+	for _, call := range headlessHistory() {
+		if call.Name == "Shell_NotifyIcon" && call.ID == message {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSetHeadlessAfterRegister(t *testing.T) {
+	if err := SetHeadless(false); err == nil {
+		t.Fatal("SetHeadless succeeded after Register")
+	}
+	if !headless.Load() {
+		t.Fatal("SetHeadless left headless mode after Register")
+	}
+}
+
+func TestHeadlessRecordsShellCalls(t *testing.T) {
+	const NIM_MODIFY = 0x00000001
+	resetHeadlessHistory()
+	if err := SetTooltip("Headless"); err != nil {
+		t.Fatal(err)
+	}
+	if n := notifyIconCalls(NIM_MODIFY); n != 1 {
+		t.Fatalf("got %d NIM_MODIFY calls, want 1", n)
+	}
+}
+
+func TestHeadlessHistoryIsCapped(t *testing.T) {
+	resetHeadlessHistory()
+	defer resetHeadlessHistory()
+	for i := 0; i < maxHeadlessCalls+10; i++ {
+		recordHeadless("Test", 0, uint32(i))
+	}
+	calls := headlessHistory()
+	if len(calls) > maxHeadlessCalls {
+		t.Fatalf("history holds %d calls, want at most %d", len(calls), maxHeadlessCalls)
+	}
+	// The most recent calls are kept
+	if last := calls[len(calls)-1]; last.ID != maxHeadlessCalls+9 {
+		t.Fatalf("last call has ID %d, want %d", last.ID, maxHeadlessCalls+9)
+	}
+}
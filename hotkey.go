@@ -0,0 +1,174 @@
+//go:build windows
+
+package wintray
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Modifiers is a combination of modifier keys, for hotkeys and clicks.
+type Modifiers uint32
+
+// Modifier keys, with the values used by RegisterHotKey.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-registerhotkey
+const (
+	ModAlt     Modifiers = 0x0001
+	ModControl Modifiers = 0x0002
+	ModShift   Modifiers = 0x0004
+	ModWin     Modifiers = 0x0008
+)
+
+// Return the modifier keys held down when the message being processed was sent.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-getkeystate
+func keyModifiers() Modifiers {
+	const (
+		VK_SHIFT   = 0x10
+		VK_CONTROL = 0x11
+		VK_MENU    = 0x12
+		VK_LWIN    = 0x5B
+		VK_RWIN    = 0x5C
+	)
+	down := func(vk uintptr) bool {
+		// The high bit is set while the key is down
+		state, _, _ := pGetKeyState.Call(vk)
+		return state&0x8000 != 0
+	}
+	var mods Modifiers
+	if down(VK_SHIFT) {
+		mods |= ModShift
+	}
+	if down(VK_CONTROL) {
+		mods |= ModControl
+	}
+	if down(VK_MENU) {
+		mods |= ModAlt
+	}
+	if down(VK_LWIN) || down(VK_RWIN) {
+		mods |= ModWin
+	}
+	return mods
+}
+
+// Register a global hotkey that clicks the menu item, and show it next to the title.
+// vk is a virtual-key code such as 'A' or 0x70 for F1.
+// Pass 0 as vk to remove the hotkey. The hotkey is removed along with the menu item.
+// https://learn.microsoft.com/en-us/windows/win32/inputdev/virtual-key-codes
+func (item *MenuItem) SetHotkey(modifiers Modifiers, vk uint32) error {
+	if !wt.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	err := item.removeHotkey()
+	if err == nil && vk != 0 {
+		const MOD_NOREPEAT = 0x4000
+		err = wt.runOnLoop(func() error {
+			res, _, err := pRegisterHotKey.Call(
+				uintptr(wt.window),
+				uintptr(item.id),
+				uintptr(modifiers|MOD_NOREPEAT),
+				uintptr(vk),
+			)
+			if res == 0 {
+				return err
+			}
+			return nil
+		})
+		if err == nil {
+			item.mu.Lock()
+			item.hotkeyVK, item.hotkeyText = vk, hotkeyText(modifiers, vk)
+			item.mu.Unlock()
+		}
+	}
+	item.update()
+	if err != nil {
+		return fmt.Errorf("failed to set hotkey: %w", err)
+	}
+	return nil
+}
+
+// Unregister the hotkey of the menu item with the given ID.
+// Must be called on the message loop thread.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-unregisterhotkey
+func (t *winTray) unregisterHotkey(id uint32) error {
+	res, _, err := pUnregisterHotKey.Call(uintptr(t.window), uintptr(id))
+	if res == 0 {
+		return err
+	}
+	return nil
+}
+
+// Unregister the hotkeys of all menu items.
+// Must be called on the message loop thread.
+func (t *winTray) unregisterHotkeys() {
+	menuItemsLock.RLock()
+	defer menuItemsLock.RUnlock()
+	for id, item := range menuItems {
+		item.mu.RLock()
+		registered := item.hotkeyVK != 0
+		item.mu.RUnlock()
+		if registered {
+			t.unregisterHotkey(id)
+		}
+	}
+}
+
+// Unregister the hotkey of the menu item, if any.
+func (item *MenuItem) removeHotkey() error {
+	item.mu.Lock()
+	registered := item.hotkeyVK != 0
+	item.hotkeyVK, item.hotkeyText = 0, ""
+	item.mu.Unlock()
+	if !registered {
+		return nil
+	}
+	return wt.runOnLoop(func() error { return wt.unregisterHotkey(item.id) })
+}
+
+// Click the menu item whose hotkey was pressed.
+func (t *winTray) handleHotkey(id uint32) {
+	if !interactive.Load() {
+		return
+	}
+	menuItemsLock.RLock()
+	item, ok := menuItems[id]
+	menuItemsLock.RUnlock()
+	if ok {
+		item.Click()
+	}
+}
+
+// Return the text shown next to the title for a hotkey, e.g. "Ctrl+Shift+A".
+func hotkeyText(modifiers Modifiers, vk uint32) string {
+	var parts []string
+	if modifiers&ModControl != 0 {
+		parts = append(parts, "Ctrl")
+	}
+	if modifiers&ModAlt != 0 {
+		parts = append(parts, "Alt")
+	}
+	if modifiers&ModShift != 0 {
+		parts = append(parts, "Shift")
+	}
+	if modifiers&ModWin != 0 {
+		parts = append(parts, "Win")
+	}
+	return strings.Join(append(parts, keyName(vk)), "+")
+}
+
+// Return the name of a virtual key in the keyboard layout of the user.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-getkeynametextw
+func keyName(vk uint32) string {
+	const MAPVK_VK_TO_VSC = 0
+	scanCode, _, _ := pMapVirtualKey.Call(uintptr(vk), MAPVK_VK_TO_VSC)
+	if scanCode != 0 {
+		buf := make([]uint16, 64)
+		n, _, _ := pGetKeyNameText.Call(scanCode<<16, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+		if n != 0 {
+			return windows.UTF16ToString(buf[:n])
+		}
+	}
+	return fmt.Sprintf("0x%02X", vk)
+}
@@ -0,0 +1,170 @@
+//go:build windows
+
+package wintray
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// errNotIconFile is returned by loadIconFileForSize for files that aren't .ico images.
+var errNotIconFile = errors.New("not an .ico file")
+
+// Extract the small version of the icon at index in an executable, DLL or .ico file.
+// ExtractIconEx: https://learn.microsoft.com/en-us/windows/win32/api/shellapi/nf-shellapi-extracticonexw
+func extractIcon(path string, index int) (windows.Handle, error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var hIcon windows.Handle
+	res, _, err := pExtractIconEx.Call(
+		uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(int32(index)),
+		0,
+		uintptr(unsafe.Pointer(&hIcon)),
+		1,
+	)
+	if uint32(res) == 0xFFFFFFFF {
+		return 0, err
+	}
+	if res == 0 || hIcon == 0 {
+		return 0, fmt.Errorf("no icon at index %d in %s", index, path)
+	}
+	return hIcon, nil
+}
+
+// Return the size of small icons, such as the tray icon and menu item icons,
+// at the DPI of the tray window.
+func (t *winTray) smallIconSize() (cx, cy int) {
+	const SM_CXSMICON = 49
+	const SM_CYSMICON = 50
+	if t.window != 0 && pGetDpiForWindow.Find() == nil && pGetSystemMetricsForDpi.Find() == nil {
+		dpi, _, _ := pGetDpiForWindow.Call(uintptr(t.window))
+		if dpi != 0 {
+			x, _, _ := pGetSystemMetricsForDpi.Call(SM_CXSMICON, dpi)
+			y, _, _ := pGetSystemMetricsForDpi.Call(SM_CYSMICON, dpi)
+			return int(x), int(y)
+		}
+	}
+	x, _, _ := pGetSystemMetrics.Call(SM_CXSMICON)
+	y, _, _ := pGetSystemMetrics.Call(SM_CYSMICON)
+	return int(x), int(y)
+}
+
+// Load the image in a .ico file that best matches the given size.
+// Unlike LoadImage with LR_DEFAULTSIZE, this avoids upscaling a small image
+// when the file contains a larger one that fits better.
+func loadIconFileForSize(path string, cx, cy int) (windows.Handle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	h, _, err := createIconForSize(data, cx, cy)
+	return h, err
+}
+
+// Set the systray icon from the image of the .ico data that best matches targetSize pixels,
+// scaled to exactly that size, e.g. to pick the sharpest image for a fractional scaling factor.
+// It returns the width of the image picked from the data, which differs from targetSize
+// if the data has no image of that size so that it had to be scaled.
+func SetIconScaled(iconBytes []byte, targetSize int) (imageSize int, err error) {
+	if !wt.isReady() {
+		return 0, ErrTrayNotReadyYet
+	}
+	if quitting.Load() {
+		return 0, ErrTrayQuitting
+	}
+	if targetSize <= 0 {
+		return 0, fmt.Errorf("invalid icon size %d", targetSize)
+	}
+	h, imageSize, err := createIconForSize(iconBytes, targetSize, targetSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load icon: %w", err)
+	}
+	if err := wt.setTrayIcon(h, true, append([]byte(nil), iconBytes...)); err != nil {
+		return 0, fmt.Errorf("failed to set icon: %w", err)
+	}
+	return imageSize, nil
+}
+
+// Create an icon from the image in the .ico data that best matches the given size,
+// and return the width of that image.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-lookupiconidfromdirectoryex
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-createiconfromresourceex
+func createIconForSize(data []byte, cx, cy int) (windows.Handle, int, error) {
+	const LR_DEFAULTCOLOR = 0x00000000
+	const iconVersion = 0x00030000
+	const (
+		headerSize    = 6
+		fileEntrySize = 16
+		resEntrySize  = 14
+	)
+
+	// The file has an ICONDIR header followed by ICONDIRENTRY structures.
+	if len(data) < headerSize ||
+		binary.LittleEndian.Uint16(data[0:]) != 0 ||
+		binary.LittleEndian.Uint16(data[2:]) != 1 {
+		return 0, 0, errNotIconFile
+	}
+	count := int(binary.LittleEndian.Uint16(data[4:]))
+	if count == 0 || len(data) < headerSize+count*fileEntrySize {
+		return 0, 0, errNotIconFile
+	}
+
+	// LookupIconIdFromDirectoryEx expects the resource format, where each entry
+	// has an ID instead of a file offset, so convert the directory.
+	dir := make([]byte, headerSize+count*resEntrySize)
+	copy(dir, data[:headerSize])
+	for i := 0; i < count; i++ {
+		src := data[headerSize+i*fileEntrySize:]
+		dst := dir[headerSize+i*resEntrySize:]
+		copy(dst[:12], src[:12])
+		binary.LittleEndian.PutUint16(dst[12:], uint16(i+1))
+	}
+	id, _, err := pLookupIconIdFromDirectoryEx.Call(
+		uintptr(unsafe.Pointer(&dir[0])),
+		1,
+		uintptr(cx),
+		uintptr(cy),
+		LR_DEFAULTCOLOR,
+	)
+	if id == 0 || int(id) > count {
+		const ERROR_SUCCESS syscall.Errno = 0
+		if id == 0 && err.(syscall.Errno) != ERROR_SUCCESS {
+			return 0, 0, fmt.Errorf("no suitable image in icon file: %w", err)
+		}
+		return 0, 0, errors.New("no suitable image in icon file")
+	}
+
+	entry := data[headerSize+(int(id)-1)*fileEntrySize:]
+	width := int(entry[0])
+	if width == 0 {
+		// Images of 256 pixels are stored with a width of 0
+		width = 256
+	}
+	size := binary.LittleEndian.Uint32(entry[8:])
+	offset := binary.LittleEndian.Uint32(entry[12:])
+	if size == 0 || uint64(offset)+uint64(size) > uint64(len(data)) {
+		return 0, 0, errNotIconFile
+	}
+	res, _, err := pCreateIconFromResourceEx.Call(
+		uintptr(unsafe.Pointer(&data[offset])),
+		uintptr(size),
+		1,
+		iconVersion,
+		uintptr(cx),
+		uintptr(cy),
+		LR_DEFAULTCOLOR,
+	)
+	if res == 0 {
+		return 0, 0, err
+	}
+	return windows.Handle(res), width, nil
+}
@@ -0,0 +1,166 @@
+//go:build windows
+
+package wintray
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var pGetObject = g32.NewProc("GetObjectW")
+
+// Describes a bitmap, as returned by GetObject.
+// https://learn.microsoft.com/en-us/windows/win32/api/wingdi/ns-wingdi-bitmap
+type bitmap struct {
+	Type, Width, Height, WidthBytes int32
+	Planes, BitsPixel               uint16
+	Bits                            unsafe.Pointer
+}
+
+// Return the size and the 32-bit pixels of a DIB section, in bottom-up row order.
+func bitmapPixels(t *testing.T, h windows.Handle) (width, height int, pixels []uint32) {
+	t.Helper()
+	var bm bitmap
+	res, _, err := pGetObject.Call(uintptr(h), unsafe.Sizeof(bm), uintptr(unsafe.Pointer(&bm)))
+	if res == 0 {
+		t.Fatalf("failed to get bitmap: %s", err)
+	}
+	if bm.BitsPixel != 32 || bm.Bits == nil {
+		t.Fatalf("not a 32-bit DIB section: %+v", bm)
+	}
+	width, height = int(bm.Width), int(bm.Height)
+	return width, height, unsafe.Slice((*uint32)(bm.Bits), width*height)
+}
+
+func TestIconToBitmapAppliesMask(t *testing.T) {
+	// A 256-color icon without alpha channel, red in the middle
+	// and transparent through its AND mask around it
+	h, err := wt.loadIconUncached("testdata/masked256.ico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pDestroyIcon.Call(uintptr(h))
+	bmp, err := iconToBitmap(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pDeleteObject.Call(uintptr(bmp))
+
+	width, height, pixels := bitmapPixels(t, bmp)
+	if corner := pixels[0]; corner>>24 != 0 {
+		t.Errorf("masked corner pixel is %#08x, want transparent", corner)
+	}
+	if center := pixels[height/2*width+width/2]; center != 0xFFFF0000 {
+		t.Errorf("center pixel is %#08x, want opaque red", center)
+	}
+}
+
+func TestSetIconConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	if err := SetIconTempDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer SetIconTempDir("")
+	icon := testIcon(16, 0xFF00FF00)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- SetIcon(icon)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// All the goroutines share one complete file, and no temporary file is left
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d files in the icon directory, want 1", len(files))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, icon) {
+		t.Error("icon file doesn't hold the icon")
+	}
+}
+
+func TestIconToBitmapTransparentCorners(t *testing.T) {
+	// A 32-bit icon, opaque blue in the middle and transparent around it
+	const size = 16
+	data := testIcon(size, 0xFF0000FF)
+	const pixelsOffset = 6 + 16 + 40
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if x < 4 || x >= 12 || y < 4 || y >= 12 {
+				binary.LittleEndian.PutUint32(data[pixelsOffset+(y*size+x)*4:], 0)
+			}
+		}
+	}
+	path := filepath.Join(t.TempDir(), "icon.ico")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := wt.loadIconUncached(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pDestroyIcon.Call(uintptr(h))
+	bmp, err := iconToBitmap(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pDeleteObject.Call(uintptr(bmp))
+
+	// The menu background must show through, rather than the black of uninitialized bits
+	width, height, pixels := bitmapPixels(t, bmp)
+	corners := []int{0, width - 1, (height - 1) * width, height*width - 1}
+	for _, i := range corners {
+		if p := pixels[i]; p>>24 != 0 {
+			t.Errorf("corner pixel %d is %#08x, want transparent", i, p)
+		}
+	}
+	if center := pixels[height/2*width+width/2]; center != 0xFF0000FF {
+		t.Errorf("center pixel is %#08x, want opaque blue", center)
+	}
+}
+
+func TestSetIconFromImageAfterQuit(t *testing.T) {
+	wt.muNID.Lock()
+	before := wt.trayIcon
+	wt.muNID.Unlock()
+
+	quitting.Store(true)
+	err := SetIconFromImage(image.NewRGBA(image.Rect(0, 0, 16, 16)))
+	quitting.Store(false)
+	if !errors.Is(err, ErrTrayQuitting) {
+		t.Errorf("got error %v after Quit, want %v", err, ErrTrayQuitting)
+	}
+	wt.muNID.Lock()
+	after := wt.trayIcon
+	wt.muNID.Unlock()
+	if after != before {
+		t.Error("icon changed after Quit")
+	}
+}
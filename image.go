@@ -0,0 +1,132 @@
+//go:build windows
+
+package wintray
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"  // register GIF decoding for SetIconFromImageBytes
+	_ "image/jpeg" // register JPEG decoding for SetIconFromImageBytes
+	"image/png"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Set the systray icon from an image, scaled to the tray icon size.
+func SetIconFromImage(img image.Image) error {
+	if !wt.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	cx, cy := wt.smallIconSize()
+	h, err := imageToIcon(img, cx, cy)
+	if err != nil {
+		return fmt.Errorf("failed to convert image to icon: %w", err)
+	}
+	if err := wt.setTrayIcon(h, true, nil); err != nil {
+		return fmt.Errorf("failed to set icon: %w", err)
+	}
+	return nil
+}
+
+// Set the systray icon from the content of a .png image.
+func SetIconFromPNG(pngBytes []byte) error {
+	img, err := png.Decode(bytes.NewReader(pngBytes))
+	if err != nil {
+		return fmt.Errorf("failed to decode PNG image: %w", err)
+	}
+	return SetIconFromImage(img)
+}
+
+// Set the systray icon from the content of a .ico, .png, .jpg or .gif image.
+// The format is detected from the content.
+func SetIconFromImageBytes(imageBytes []byte) error {
+	if bytes.HasPrefix(imageBytes, []byte{0, 0, 1, 0}) {
+		return SetIcon(imageBytes)
+	}
+	img, _, err := image.Decode(bytes.NewReader(imageBytes))
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+	return SetIconFromImage(img)
+}
+
+// Create an icon of the given size from an image.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-createiconindirect
+func imageToIcon(img image.Image, cx, cy int) (windows.Handle, error) {
+	hDC, _, err := pGetDC.Call(uintptr(0))
+	if hDC == 0 {
+		return 0, err
+	}
+	defer pReleaseDC.Call(uintptr(0), hDC)
+	hColor, bits, err := create32BitHBitmap(hDC, int32(cx), int32(cy))
+	if err != nil {
+		return 0, err
+	}
+	defer pDeleteObject.Call(hColor)
+	// The mask is ignored for 32-bit icons with an alpha channel, but must exist
+	hMask, _, err := pCreateBitmap.Call(uintptr(cx), uintptr(cy), 1, 1, 0)
+	if hMask == 0 {
+		return 0, err
+	}
+	defer pDeleteObject.Call(hMask)
+
+	pixels := unsafe.Slice((*uint32)(bits), cx*cy)
+	scaleImage(img, cx, cy, func(x, y int, c color.NRGBA) {
+		// Rows are stored bottom-up; icons use straight (not premultiplied) alpha
+		pixels[(cy-1-y)*cx+x] = uint32(c.A)<<24 | uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+	})
+
+	ii := iconInfo{
+		Icon:  1,
+		Mask:  windows.Handle(hMask),
+		Color: windows.Handle(hColor),
+	}
+	res, _, err := pCreateIconIndirect.Call(uintptr(unsafe.Pointer(&ii)))
+	if res == 0 {
+		return 0, err
+	}
+	return windows.Handle(res), nil
+}
+
+// Scale an image to the given size by averaging the source pixels that
+// cover each destination pixel, calling set for each destination pixel.
+func scaleImage(img image.Image, cx, cy int, set func(x, y int, c color.NRGBA)) {
+	b := img.Bounds()
+	for y := 0; y < cy; y++ {
+		y0 := b.Min.Y + y*b.Dy()/cy
+		y1 := b.Min.Y + (y+1)*b.Dy()/cy
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < cx; x++ {
+			x0 := b.Min.X + x*b.Dx()/cx
+			x1 := b.Min.X + (x+1)*b.Dx()/cx
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			// Average in premultiplied space so transparent pixels don't darken edges
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					bl += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			c := color.NRGBA{}
+			if a > 0 {
+				c.R = uint8(r * 0xFF / a)
+				c.G = uint8(g * 0xFF / a)
+				c.B = uint8(bl * 0xFF / a)
+				c.A = uint8(a / n >> 8)
+			}
+			set(x, y, c)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+//go:build windows
+
+package wintray
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// menuAPI wraps the Win32 functions used to build the menus, so that the
+// bookkeeping of visibleItems, menus and menuOf can be exercised with a fake
+// implementation that doesn't need a desktop session.
+type menuAPI interface {
+	CreateMenu() (windows.Handle, error)
+	CreatePopupMenu() (windows.Handle, error)
+	DestroyMenu(menu windows.Handle) error
+	SetMenuInfo(menu windows.Handle, mi *menuInfo) error
+	InsertMenuItem(menu windows.Handle, position int, mi *menuItemInfo) error
+	SetMenuItemInfo(menu windows.Handle, id uint32, mi *menuItemInfo) error
+	DeleteMenu(menu windows.Handle, id uint32) error
+	RemoveMenu(menu windows.Handle, id uint32) error
+}
+
+// win32MenuAPI implements menuAPI by calling the Win32 functions.
+type win32MenuAPI struct{}
+
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-createmenu
+func (win32MenuAPI) CreateMenu() (windows.Handle, error) {
+	res, _, err := pCreateMenu.Call()
+	if res == 0 {
+		return 0, err
+	}
+	return windows.Handle(res), nil
+}
+
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-createpopupmenu
+func (win32MenuAPI) CreatePopupMenu() (windows.Handle, error) {
+	res, _, err := pCreatePopupMenu.Call()
+	if res == 0 {
+		return 0, err
+	}
+	return windows.Handle(res), nil
+}
+
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-destroymenu
+func (win32MenuAPI) DestroyMenu(menu windows.Handle) error {
+	res, _, err := pDestroyMenu.Call(uintptr(menu))
+	if res == 0 {
+		return err
+	}
+	return nil
+}
+
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-setmenuinfo
+func (win32MenuAPI) SetMenuInfo(menu windows.Handle, mi *menuInfo) error {
+	mi.Size = uint32(unsafe.Sizeof(*mi))
+	res, _, err := pSetMenuInfo.Call(
+		uintptr(menu),
+		uintptr(unsafe.Pointer(mi)),
+	)
+	if res == 0 {
+		return err
+	}
+	return nil
+}
+
+// Insert a menu item at the given position.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-insertmenuitemw
+func (win32MenuAPI) InsertMenuItem(menu windows.Handle, position int, mi *menuItemInfo) error {
+	mi.Size = uint32(unsafe.Sizeof(*mi))
+	res, _, err := pInsertMenuItem.Call(
+		uintptr(menu),
+		uintptr(position),
+		1,
+		uintptr(unsafe.Pointer(mi)),
+	)
+	if res == 0 {
+		return err
+	}
+	return nil
+}
+
+// Change the menu item with the given ID.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-setmenuiteminfow
+func (win32MenuAPI) SetMenuItemInfo(menu windows.Handle, id uint32, mi *menuItemInfo) error {
+	mi.Size = uint32(unsafe.Sizeof(*mi))
+	res, _, err := pSetMenuItemInfo.Call(
+		uintptr(menu),
+		uintptr(id),
+		0,
+		uintptr(unsafe.Pointer(mi)),
+	)
+	if res == 0 {
+		return err
+	}
+	return nil
+}
+
+// Delete the menu item with the given ID, destroying its submenu.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-deletemenu
+func (win32MenuAPI) DeleteMenu(menu windows.Handle, id uint32) error {
+	const MF_BYCOMMAND = 0x00000000
+	const ERROR_SUCCESS syscall.Errno = 0
+
+	res, _, err := pDeleteMenu.Call(
+		uintptr(menu),
+		uintptr(id),
+		MF_BYCOMMAND,
+	)
+	if res == 0 && err.(syscall.Errno) != ERROR_SUCCESS {
+		return err
+	}
+	return nil
+}
+
+// Remove the menu item with the given ID, keeping its submenu.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-removemenu
+func (win32MenuAPI) RemoveMenu(menu windows.Handle, id uint32) error {
+	const MF_BYCOMMAND = 0x00000000
+	const ERROR_SUCCESS syscall.Errno = 0
+
+	res, _, err := pRemoveMenu.Call(
+		uintptr(menu),
+		uintptr(id),
+		MF_BYCOMMAND,
+	)
+	if res == 0 && err.(syscall.Errno) != ERROR_SUCCESS {
+		return err
+	}
+	return nil
+}
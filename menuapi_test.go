@@ -0,0 +1,652 @@
+//go:build windows
+
+package wintray
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+// fakeMenuItem is a menu item held by fakeMenuAPI.
+type fakeMenuItem struct {
+	ID      uint32
+	Type    uint32
+	State   uint32
+	Title   string
+	SubMenu windows.Handle
+	Bitmap  windows.Handle
+}
+
+// fakeMenuAPI implements menuAPI by keeping the menus in memory, so that the tests
+// can check what would be shown. Like in headless mode, the calls are also recorded.
+type fakeMenuAPI struct {
+	headlessMenuAPI
+	// Lock to protect the fields below
+	mu sync.Mutex
+	// Items of the menus in menu order, by menu handle
+	menus map[windows.Handle][]*fakeMenuItem
+	// Settings of the menus
+	infos map[windows.Handle]menuInfo
+	// Menus that have been destroyed
+	destroyed map[windows.Handle]bool
+}
+
+// Menu API used by the tests, set up by TestMain
+var testMenus = &fakeMenuAPI{
+	menus:     make(map[windows.Handle][]*fakeMenuItem),
+	infos:     make(map[windows.Handle]menuInfo),
+	destroyed: make(map[windows.Handle]bool),
+}
+
+func (a *fakeMenuAPI) CreateMenu() (windows.Handle, error) {
+	menu, err := a.headlessMenuAPI.CreateMenu()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.menus[menu] = nil
+	return menu, err
+}
+
+func (a *fakeMenuAPI) CreatePopupMenu() (windows.Handle, error) {
+	menu, err := a.headlessMenuAPI.CreatePopupMenu()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.menus[menu] = nil
+	return menu, err
+}
+
+func (a *fakeMenuAPI) DestroyMenu(menu windows.Handle) error {
+	a.headlessMenuAPI.DestroyMenu(menu)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.checkMenu(menu); err != nil {
+		return err
+	}
+	a.destroy(menu)
+	return nil
+}
+
+func (a *fakeMenuAPI) SetMenuInfo(menu windows.Handle, mi *menuInfo) error {
+	a.headlessMenuAPI.SetMenuInfo(menu, mi)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.checkMenu(menu); err != nil {
+		return err
+	}
+	a.infos[menu] = *mi
+	return nil
+}
+
+func (a *fakeMenuAPI) InsertMenuItem(menu windows.Handle, position int, mi *menuItemInfo) error {
+	a.headlessMenuAPI.InsertMenuItem(menu, position, mi)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.checkMenu(menu); err != nil {
+		return err
+	}
+	items := a.menus[menu]
+	// Inserting past the end would hide a mismatch between visibleItems and the menu
+	if position < 0 || position > len(items) {
+		return fmt.Errorf("position %d out of range in menu of %d items", position, len(items))
+	}
+	if indexOfFakeItem(items, mi.ID) != -1 {
+		return fmt.Errorf("menu item %d inserted twice", mi.ID)
+	}
+	item := &fakeMenuItem{ID: mi.ID}
+	if err := a.set(item, mi); err != nil {
+		return err
+	}
+	items = append(items, nil)
+	copy(items[position+1:], items[position:])
+	items[position] = item
+	a.menus[menu] = items
+	return nil
+}
+
+func (a *fakeMenuAPI) SetMenuItemInfo(menu windows.Handle, id uint32, mi *menuItemInfo) error {
+	a.headlessMenuAPI.SetMenuItemInfo(menu, id, mi)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.checkMenu(menu); err != nil {
+		return err
+	}
+	i := indexOfFakeItem(a.menus[menu], id)
+	if i == -1 {
+		return fmt.Errorf("no menu item %d in menu %d", id, menu)
+	}
+	return a.set(a.menus[menu][i], mi)
+}
+
+func (a *fakeMenuAPI) DeleteMenu(menu windows.Handle, id uint32) error {
+	a.headlessMenuAPI.DeleteMenu(menu, id)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	item, err := a.remove(menu, id)
+	if err != nil {
+		return err
+	}
+	if item.SubMenu != 0 {
+		a.destroy(item.SubMenu)
+	}
+	return nil
+}
+
+func (a *fakeMenuAPI) RemoveMenu(menu windows.Handle, id uint32) error {
+	a.headlessMenuAPI.RemoveMenu(menu, id)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err := a.remove(menu, id)
+	return err
+}
+
+// Return an error if the menu doesn't exist. Must be called with mu held.
+func (a *fakeMenuAPI) checkMenu(menu windows.Handle) error {
+	if _, ok := a.menus[menu]; !ok || a.destroyed[menu] {
+		return fmt.Errorf("invalid menu handle %d", menu)
+	}
+	return nil
+}
+
+// Apply the fields of mi selected by its mask to the item. Must be called with mu held.
+func (a *fakeMenuAPI) set(item *fakeMenuItem, mi *menuItemInfo) error {
+	const (
+		MIIM_STATE   = 0x00000001
+		MIIM_SUBMENU = 0x00000004
+		MIIM_STRING  = 0x00000040
+		MIIM_BITMAP  = 0x00000080
+		MIIM_FTYPE   = 0x00000100
+	)
+	if mi.Mask&MIIM_SUBMENU != 0 && mi.SubMenu != 0 {
+		if err := a.checkMenu(mi.SubMenu); err != nil {
+			return err
+		}
+	}
+	if mi.Mask&MIIM_FTYPE != 0 {
+		item.Type = mi.Type
+	}
+	if mi.Mask&MIIM_STATE != 0 {
+		item.State = mi.State
+	}
+	if mi.Mask&MIIM_STRING != 0 {
+		item.Title = windows.UTF16PtrToString(mi.TypeData)
+	}
+	if mi.Mask&MIIM_SUBMENU != 0 {
+		item.SubMenu = mi.SubMenu
+	}
+	if mi.Mask&MIIM_BITMAP != 0 {
+		item.Bitmap = mi.BMPItem
+	}
+	return nil
+}
+
+// Take the item out of the menu. Must be called with mu held.
+func (a *fakeMenuAPI) remove(menu windows.Handle, id uint32) (*fakeMenuItem, error) {
+	if err := a.checkMenu(menu); err != nil {
+		return nil, err
+	}
+	items := a.menus[menu]
+	i := indexOfFakeItem(items, id)
+	if i == -1 {
+		return nil, fmt.Errorf("no menu item %d in menu %d", id, menu)
+	}
+	item := items[i]
+	a.menus[menu] = append(items[:i], items[i+1:]...)
+	return item, nil
+}
+
+// Destroy a menu along with its submenus, like DestroyMenu. Must be called with mu held.
+func (a *fakeMenuAPI) destroy(menu windows.Handle) {
+	for _, item := range a.menus[menu] {
+		if item.SubMenu != 0 {
+			a.destroy(item.SubMenu)
+		}
+	}
+	a.destroyed[menu] = true
+}
+
+// Return the index of the item with the given ID, or -1.
+func indexOfFakeItem(items []*fakeMenuItem, id uint32) int {
+	for i, item := range items {
+		if item.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Return the IDs of the items of a menu, in menu order.
+func (a *fakeMenuAPI) ids(menu windows.Handle) []uint32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ids := []uint32{}
+	for _, item := range a.menus[menu] {
+		ids = append(ids, item.ID)
+	}
+	return ids
+}
+
+// Return a copy of the item with the given ID in a menu, failing the test if it isn't there.
+func (a *fakeMenuAPI) item(t *testing.T, menu windows.Handle, id uint32) fakeMenuItem {
+	t.Helper()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i := indexOfFakeItem(a.menus[menu], id)
+	if i == -1 {
+		t.Fatalf("no menu item %d in menu %d", id, menu)
+	}
+	return *a.menus[menu][i]
+}
+
+// Return the settings of a menu.
+func (a *fakeMenuAPI) info(menu windows.Handle) menuInfo {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.infos[menu]
+}
+
+// Return whether a menu has been destroyed.
+func (a *fakeMenuAPI) isDestroyed(menu windows.Handle) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.destroyed[menu]
+}
+
+// Start a test with an empty menu, returning the handle of the main menu.
+func resetMenu(t *testing.T) windows.Handle {
+	t.Helper()
+	ResetMenu()
+	menu := rootMenu()
+	if ids := testMenus.ids(menu); len(ids) != 0 {
+		t.Fatalf("menu not empty after ResetMenu: %v", ids)
+	}
+	return menu
+}
+
+// Return the handle of the main menu.
+func rootMenu() windows.Handle {
+	wt.muMenus.RLock()
+	defer wt.muMenus.RUnlock()
+	return wt.menus[0]
+}
+
+// Return the handle of the submenu of the item, or 0.
+func subMenu(item *MenuItem) windows.Handle {
+	wt.muMenus.RLock()
+	defer wt.muMenus.RUnlock()
+	return wt.menus[item.id]
+}
+
+// Check that a menu holds the items in that order, and that visibleItems agrees.
+func checkMenu(t *testing.T, menu windows.Handle, parent *MenuItem, items ...*MenuItem) {
+	t.Helper()
+	want := []uint32{}
+	for _, item := range items {
+		want = append(want, item.id)
+	}
+	if got := testMenus.ids(menu); !reflect.DeepEqual(got, want) {
+		t.Fatalf("menu holds items %v, want %v", got, want)
+	}
+	var parentId uint32
+	if parent != nil {
+		parentId = parent.id
+	}
+	wt.muVisibleItems.RLock()
+	visible := append([]uint32{}, wt.visibleItems[parentId]...)
+	wt.muVisibleItems.RUnlock()
+	if !reflect.DeepEqual(visible, want) {
+		t.Fatalf("visibleItems holds %v, want %v", visible, want)
+	}
+}
+
+func TestMenuAdd(t *testing.T) {
+	root := resetMenu(t)
+	a := AddMenuItem("A")
+	b := AddMenuItem("B")
+	sep := AddSeparator()
+	c := AddMenuItem("C")
+	checkMenu(t, root, nil, a, b, sep, c)
+
+	if title := testMenus.item(t, root, b.id).Title; title != "B" {
+		t.Errorf("menu shows title %q, want %q", title, "B")
+	}
+	const MFT_SEPARATOR = 0x00000800
+	if typ := testMenus.item(t, root, sep.id).Type; typ&MFT_SEPARATOR == 0 {
+		t.Error("separator not shown as a separator")
+	}
+}
+
+func TestMenuUpdate(t *testing.T) {
+	const (
+		MFS_CHECKED  = 0x00000008
+		MFS_DISABLED = 0x00000003
+	)
+	root := resetMenu(t)
+	a := AddMenuItem("A")
+	b := AddMenuItem("B")
+
+	a.SetTitle("A2")
+	a.Check()
+	a.Disable()
+	checkMenu(t, root, nil, a, b)
+	item := testMenus.item(t, root, a.id)
+	if item.Title != "A2" {
+		t.Errorf("menu shows title %q, want %q", item.Title, "A2")
+	}
+	if item.State != MFS_CHECKED|MFS_DISABLED {
+		t.Errorf("menu item has state %#x, want %#x", item.State, MFS_CHECKED|MFS_DISABLED)
+	}
+
+	a.Uncheck()
+	a.Enable()
+	if state := testMenus.item(t, root, a.id).State; state != 0 {
+		t.Errorf("menu item has state %#x, want 0", state)
+	}
+}
+
+func TestMenuHideShow(t *testing.T) {
+	root := resetMenu(t)
+	a := AddMenuItem("A")
+	b := AddMenuItem("B")
+	c := AddMenuItem("C")
+
+	b.Hide()
+	checkMenu(t, root, nil, a, c)
+	a.Hide()
+	checkMenu(t, root, nil, c)
+	b.Show()
+	checkMenu(t, root, nil, b, c)
+	a.Show()
+	checkMenu(t, root, nil, a, b, c)
+}
+
+func TestMenuSubMenu(t *testing.T) {
+	root := resetMenu(t)
+	parent := AddMenuItem("Parent")
+	if parent.HasSubMenu() {
+		t.Fatal("item has a submenu before adding children")
+	}
+	a := parent.AddSubMenuItem("A")
+	b := parent.AddSubMenuItem("B")
+	other := AddMenuItem("Other")
+
+	sub := subMenu(parent)
+	if sub == 0 || !parent.HasSubMenu() {
+		t.Fatal("no submenu created for the children")
+	}
+	if got := testMenus.item(t, root, parent.id).SubMenu; got != sub {
+		t.Fatalf("item shows submenu %d, want %d", got, sub)
+	}
+	checkMenu(t, root, nil, parent, other)
+	checkMenu(t, sub, parent, a, b)
+
+	b.SetTitle("B2")
+	if title := testMenus.item(t, sub, b.id).Title; title != "B2" {
+		t.Errorf("submenu shows title %q, want %q", title, "B2")
+	}
+}
+
+func TestMenuReset(t *testing.T) {
+	oldRoot := resetMenu(t)
+	parent := AddMenuItem("Parent")
+	parent.AddSubMenuItem("Child")
+	AddMenuItem("Other")
+	sub := subMenu(parent)
+
+	root := resetMenu(t)
+	if root == oldRoot {
+		t.Fatal("main menu not recreated")
+	}
+	if !testMenus.isDestroyed(oldRoot) || !testMenus.isDestroyed(sub) {
+		t.Error("old menus not destroyed")
+	}
+
+	// The new menu is usable
+	a := AddMenuItem("A")
+	checkMenu(t, root, nil, a)
+}
+
+func TestMenuConcurrentAddRemove(t *testing.T) {
+	root := resetMenu(t)
+	const goroutines, perGoroutine = 8, 50
+
+	var wg sync.WaitGroup
+	kept := make([][]*MenuItem, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perGoroutine; j++ {
+				item := AddMenuItem(fmt.Sprintf("Item %d.%d", i, j))
+				if j%2 == 0 {
+					item.Remove()
+				} else {
+					kept[i] = append(kept[i], item)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// An insertion at a stale position would put the items out of ID order
+	ids := testMenus.ids(root)
+	if len(ids) != goroutines*perGoroutine/2 {
+		t.Fatalf("menu holds %d items, want %d", len(ids), goroutines*perGoroutine/2)
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i-1] >= ids[i] {
+			t.Fatalf("menu items out of order: %v", ids)
+		}
+	}
+	wt.muVisibleItems.RLock()
+	visible := append([]uint32{}, wt.visibleItems[0]...)
+	wt.muVisibleItems.RUnlock()
+	if !reflect.DeepEqual(visible, ids) {
+		t.Fatalf("visibleItems holds %v, menu holds %v", visible, ids)
+	}
+	inMenu := make(map[uint32]bool)
+	for _, id := range ids {
+		inMenu[id] = true
+	}
+	for _, items := range kept {
+		for _, item := range items {
+			if !inMenu[item.id] {
+				t.Errorf("item %d missing from the menu", item.id)
+			}
+		}
+	}
+}
+
+func TestMenuTall(t *testing.T) {
+	root := resetMenu(t)
+	defer SetMenuMaxHeight(0)
+
+	if err := SetMenuMaxHeight(300); err != nil {
+		t.Fatal(err)
+	}
+	if height := testMenus.info(root).Max; height != 300 {
+		t.Errorf("menu has maximum height %d, want 300", height)
+	}
+	items := []*MenuItem{}
+	for i := 0; i < 100; i++ {
+		item, err := AddMenuItemWait(context.Background(), fmt.Sprintf("Item %d", i))
+		if err != nil {
+			t.Fatalf("failed to add item %d: %s", i, err)
+		}
+		items = append(items, item)
+	}
+	checkMenu(t, root, nil, items...)
+
+	// Submenus are created with the same maximum height
+	items[0].AddSubMenuItem("Child")
+	if height := testMenus.info(subMenu(items[0])).Max; height != 300 {
+		t.Errorf("submenu has maximum height %d, want 300", height)
+	}
+}
+
+func TestMenuReparentLastChild(t *testing.T) {
+	root := resetMenu(t)
+	parent := AddMenuItem("Parent")
+	child := parent.AddSubMenuItem("Child")
+	sub := subMenu(parent)
+
+	if err := child.Reparent(nil); err != nil {
+		t.Fatal(err)
+	}
+	checkMenu(t, root, nil, parent, child)
+	// The parent shows no arrow to an empty submenu
+	if parent.HasSubMenu() {
+		t.Error("parent kept its submenu after its last child moved out")
+	}
+	if got := testMenus.item(t, root, parent.id).SubMenu; got != 0 {
+		t.Errorf("parent shows submenu %d", got)
+	}
+	if !testMenus.isDestroyed(sub) {
+		t.Error("empty submenu not destroyed")
+	}
+
+	// The submenu is created again when an item moves back
+	if err := child.Reparent(parent); err != nil {
+		t.Fatal(err)
+	}
+	checkMenu(t, root, nil, parent)
+	checkMenu(t, subMenu(parent), parent, child)
+}
+
+func TestMenuShowOutOfOrder(t *testing.T) {
+	root := resetMenu(t)
+	a := AddMenuItem("A")
+	sep1 := AddSeparator()
+	b := AddMenuItem("B")
+	sep2 := AddSeparator()
+	c := AddMenuItem("C")
+
+	for _, item := range []*MenuItem{c, sep1, a, sep2, b} {
+		item.Hide()
+	}
+	checkMenu(t, root, nil)
+
+	// Whatever the order they come back in, the items keep their creation order
+	c.Show()
+	sep1.Show()
+	checkMenu(t, root, nil, sep1, c)
+	b.Show()
+	a.Show()
+	checkMenu(t, root, nil, a, sep1, b, c)
+	sep2.Show()
+	checkMenu(t, root, nil, a, sep1, b, sep2, c)
+
+	b.Hide()
+	sep1.Hide()
+	b.SetTitle("B2")
+	checkMenu(t, root, nil, a, sep2, c)
+	b.Show()
+	checkMenu(t, root, nil, a, b, sep2, c)
+}
+
+func TestMenuAddOutOfOrder(t *testing.T) {
+	root := resetMenu(t)
+	// Items created first but added later go before the others
+	a := newMenuItem("A", nil)
+	b := newMenuItem("B", nil)
+	c := AddMenuItem("C")
+	b.update()
+	checkMenu(t, root, nil, b, c)
+	a.update()
+	checkMenu(t, root, nil, a, b, c)
+}
+
+func TestMenuBackgroundColor(t *testing.T) {
+	const MIM_BACKGROUND = 0x00000002
+	root := resetMenu(t)
+	defer deleteMenuBackground()
+
+	if err := SetMenuBackgroundColor(255, 255, 255); err != nil {
+		t.Fatal(err)
+	}
+	brush := windows.Handle(menuBackground.Load())
+	info := testMenus.info(root)
+	if info.Mask&MIM_BACKGROUND == 0 || info.Background != brush {
+		t.Fatalf("menu has background %d, want brush %d", info.Background, brush)
+	}
+
+	// The menus keep the current brush if the new one can't be applied
+	wt.muMenus.Lock()
+	wt.menus[0] = 0
+	wt.muMenus.Unlock()
+	err := SetMenuBackgroundColor(0, 0, 0)
+	wt.muMenus.Lock()
+	wt.menus[0] = root
+	wt.muMenus.Unlock()
+	if err == nil {
+		t.Fatal("no error for a menu that doesn't exist")
+	}
+	if got := windows.Handle(menuBackground.Load()); got != brush {
+		t.Errorf("background brush is %d after the failure, want %d", got, brush)
+	}
+	if !gdiObjectExists(brush) {
+		t.Error("brush in use was deleted")
+	}
+
+	if err := SetMenuBackgroundColor(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if gdiObjectExists(brush) {
+		t.Error("replaced brush wasn't deleted")
+	}
+}
+
+func TestMenuRemoveAllChildren(t *testing.T) {
+	root := resetMenu(t)
+	parent := AddMenuItem("Parent")
+	a := parent.AddSubMenuItem("A")
+	b := parent.AddSubMenuItem("B")
+	sub := subMenu(parent)
+
+	a.Remove()
+	if !parent.HasSubMenu() || testMenus.isDestroyed(sub) {
+		t.Fatal("submenu removed while it still has an item")
+	}
+	checkMenu(t, sub, parent, b)
+
+	b.Remove()
+	if parent.HasSubMenu() {
+		t.Error("parent kept its submenu after its last child was removed")
+	}
+	if got := testMenus.item(t, root, parent.id).SubMenu; got != 0 {
+		t.Errorf("parent shows submenu %d", got)
+	}
+	if !testMenus.isDestroyed(sub) {
+		t.Error("empty submenu not destroyed")
+	}
+	checkMenu(t, root, nil, parent)
+
+	// The parent is a plain item again, which can get a new submenu
+	c := parent.AddSubMenuItem("C")
+	checkMenu(t, subMenu(parent), parent, c)
+}
+
+func TestMenuHiddenItemStaysHidden(t *testing.T) {
+	const MFS_CHECKED = 0x00000008
+	root := resetMenu(t)
+	a := AddMenuItem("A")
+	b := AddMenuItem("B")
+
+	a.Hide()
+	a.SetTitle("A2")
+	a.Check()
+	a.Disable()
+	a.Enable()
+	checkMenu(t, root, nil, b)
+
+	// The changes made while hidden show up with the item
+	a.Show()
+	checkMenu(t, root, nil, a, b)
+	shown := testMenus.item(t, root, a.id)
+	if shown.Title != "A2" || shown.State != MFS_CHECKED {
+		t.Errorf("shown item has title %q and state %#x, want %q and %#x", shown.Title, shown.State, "A2", MFS_CHECKED)
+	}
+}
@@ -0,0 +1,234 @@
+//go:build windows
+
+package wintray
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Icon shown in a notification.
+type NotificationIcon uint32
+
+// https://learn.microsoft.com/en-us/windows/win32/api/shellapi/ns-shellapi-notifyicondataw
+const (
+	NotificationIconNone    NotificationIcon = 0x00000000 // NIIF_NONE
+	NotificationIconInfo    NotificationIcon = 0x00000001 // NIIF_INFO
+	NotificationIconWarning NotificationIcon = 0x00000002 // NIIF_WARNING
+	NotificationIconError   NotificationIcon = 0x00000003 // NIIF_ERROR
+)
+
+// NotificationOptions change how a notification is shown.
+type NotificationOptions struct {
+	// Icon shown next to the title
+	Icon NotificationIcon
+	// Don't play the notification sound
+	Silent bool
+	// Discard the notification if it can't be shown right away,
+	// e.g. because the user is in full screen mode (NIF_REALTIME)
+	Realtime bool
+}
+
+// A notification waiting for the throttle interval to pass.
+type queuedNotification struct {
+	title, message string
+	opts           NotificationOptions
+}
+
+var (
+	// Minimum time between two notifications, or 0 to show them all right away
+	notificationThrottle atomic.Int64
+	// Lock to protect the throttle state below
+	notificationLock sync.Mutex
+	// Time the last notification was shown
+	lastNotification time.Time
+	// Latest notification suppressed by the throttle, and how many were suppressed
+	pendingNotification      *queuedNotification
+	pendingNotificationCount int
+	// Timer showing the pending notification once the throttle interval has passed
+	notificationTimer *time.Timer
+	// Function making a summary of several suppressed notifications
+	notificationSummary func(count int) (title, message string)
+)
+
+// Show at most one notification per interval d, to avoid overwhelming the user.
+// Notifications arriving faster are coalesced: once the interval has passed,
+// only the latest one is shown, or a summary if SetNotificationSummary was called.
+// The default of 0 shows every notification right away.
+func SetNotificationThrottle(d time.Duration) {
+	notificationThrottle.Store(int64(d))
+}
+
+// Set a function making the title and message of the notification shown instead of
+// several notifications coalesced by the throttle, e.g. "3 new events".
+// It's only called when more than one notification was coalesced. Pass nil to show the latest one.
+func SetNotificationSummary(f func(count int) (title, message string)) {
+	notificationLock.Lock()
+	defer notificationLock.Unlock()
+	notificationSummary = f
+}
+
+// Show a notification balloon from the tray icon.
+// On Windows 10 and later, it's shown as a toast and kept in the action center.
+// The tray icon's tooltip keeps working while it's shown (NIF_SHOWTIP).
+// If the notification is delayed by SetNotificationThrottle, errors showing it are logged.
+func ShowNotification(title, message string, opts NotificationOptions) error {
+	if !wt.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	if quitting.Load() {
+		return ErrTrayQuitting
+	}
+	if d := time.Duration(notificationThrottle.Load()); d > 0 {
+		notificationLock.Lock()
+		wait := d - time.Since(lastNotification)
+		if wait > 0 || pendingNotification != nil {
+			pendingNotification = &queuedNotification{title, message, opts}
+			pendingNotificationCount++
+			if notificationTimer == nil {
+				notificationTimer = time.AfterFunc(wait, flushNotifications)
+			}
+			notificationLock.Unlock()
+			return nil
+		}
+		lastNotification = time.Now()
+		notificationLock.Unlock()
+	}
+	return showNotification(title, message, opts)
+}
+
+// Show a balloon pointing out the tray icon to new users, unless *shown is already true.
+// *shown is set to true once the balloon is shown. Saving it across restarts,
+// so the balloon is only ever shown once, is left to the application.
+// If shown is nil, the balloon is shown every time.
+func ShowIntroTip(title, body string, shown *bool) error {
+	if !wt.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	if quitting.Load() {
+		return ErrTrayQuitting
+	}
+	if shown != nil && *shown {
+		return nil
+	}
+	if err := ShowNotification(title, body, NotificationOptions{Icon: NotificationIconInfo}); err != nil {
+		return err
+	}
+	if shown != nil {
+		*shown = true
+	}
+	return nil
+}
+
+// Show the notification suppressed by the throttle, or a summary if there were several.
+func flushNotifications() {
+	notificationLock.Lock()
+	n, count, summary := pendingNotification, pendingNotificationCount, notificationSummary
+	pendingNotification = nil
+	pendingNotificationCount = 0
+	notificationTimer = nil
+	lastNotification = time.Now()
+	notificationLock.Unlock()
+	if n == nil || quitting.Load() {
+		return
+	}
+	title, message := n.title, n.message
+	if count > 1 && summary != nil {
+		title, message = summary(count)
+	}
+	if err := showNotification(title, message, n.opts); err != nil {
+		logf("systray error: %s\n", err)
+	}
+}
+
+// Show a notification right away.
+func showNotification(title, message string, opts NotificationOptions) error {
+	const (
+		NIF_INFO     = 0x00000010
+		NIF_REALTIME = 0x00000040
+		NIIF_NOSOUND = 0x00000010
+	)
+	wt.muNID.Lock()
+	defer wt.muNID.Unlock()
+	if wt.nid == nil {
+		return ErrTrayNotReadyYet
+	}
+	if !wt.iconAdded {
+		return errors.New("tray icon is hidden")
+	}
+	// Use a copy so that the notification isn't shown again by later updates of the icon
+	nid := *wt.nid
+	nid.Flags |= NIF_INFO
+	if opts.Realtime {
+		nid.Flags |= NIF_REALTIME
+	}
+	nid.InfoFlags = uint32(opts.Icon)
+	if opts.Silent {
+		nid.InfoFlags |= NIIF_NOSOUND
+	}
+	if err := setNIDText(nid.InfoTitle[:], title); err != nil {
+		return err
+	}
+	if err := setNIDText(nid.Info[:], message); err != nil {
+		return err
+	}
+	if err := nid.modify(); err != nil {
+		return fmt.Errorf("failed to show notification: %w", err)
+	}
+	return nil
+}
+
+// Notification builds a notification step by step, e.g.
+//
+//	wintray.NewNotification().Title("Backup").Body("Backup complete").Icon(wintray.NotificationIconInfo).Show()
+//
+// It's shown as a balloon of the tray icon, which Windows 10 and later turn into a toast.
+// Toasts with buttons or other actions require the WinRT toast API and aren't supported.
+// Don't create it directly, use NewNotification()
+type Notification struct {
+	title, body string
+	opts        NotificationOptions
+}
+
+// Create an empty notification.
+func NewNotification() *Notification {
+	return &Notification{}
+}
+
+// Set the title of the notification.
+func (n *Notification) Title(title string) *Notification {
+	n.title = title
+	return n
+}
+
+// Set the text of the notification.
+func (n *Notification) Body(body string) *Notification {
+	n.body = body
+	return n
+}
+
+// Set the icon shown next to the title.
+func (n *Notification) Icon(icon NotificationIcon) *Notification {
+	n.opts.Icon = icon
+	return n
+}
+
+// Don't play the notification sound.
+func (n *Notification) Silent() *Notification {
+	n.opts.Silent = true
+	return n
+}
+
+// Discard the notification if it can't be shown right away.
+func (n *Notification) Realtime() *Notification {
+	n.opts.Realtime = true
+	return n
+}
+
+// Show the notification. It can be shown again later.
+func (n *Notification) Show() error {
+	return ShowNotification(n.title, n.body, n.opts)
+}
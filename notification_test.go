@@ -0,0 +1,52 @@
+//go:build windows
+
+package wintray
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestShowIntroTip(t *testing.T) {
+	const NIM_MODIFY = 0x00000001
+
+	// No balloon is shown before Run or after Quit, and it's still due afterwards
+	shown := false
+	wt.initialized.Store(false)
+	err := ShowIntroTip("Title", "Body", &shown)
+	wt.initialized.Store(true)
+	if !errors.Is(err, ErrTrayNotReadyYet) {
+		t.Errorf("got error %v before Run, want %v", err, ErrTrayNotReadyYet)
+	}
+	quitting.Store(true)
+	err = ShowIntroTip("Title", "Body", &shown)
+	quitting.Store(false)
+	if !errors.Is(err, ErrTrayQuitting) {
+		t.Errorf("got error %v after Quit, want %v", err, ErrTrayQuitting)
+	}
+	if shown {
+		t.Fatal("balloon marked as shown after failing")
+	}
+
+	resetHeadlessHistory()
+	if err := ShowIntroTip("Title", "Body", &shown); err != nil {
+		t.Fatal(err)
+	}
+	if !shown || notifyIconCalls(NIM_MODIFY) != 1 {
+		t.Fatal("balloon not shown")
+	}
+	if err := ShowIntroTip("Title", "Body", &shown); err != nil {
+		t.Fatal(err)
+	}
+	if n := notifyIconCalls(NIM_MODIFY); n != 1 {
+		t.Errorf("balloon shown %d times, want once", n)
+	}
+
+	// Without a flag to track it, the balloon is shown every time
+	if err := ShowIntroTip("Title", "Body", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := notifyIconCalls(NIM_MODIFY); n != 2 {
+		t.Errorf("got %d balloons, want 2", n)
+	}
+}
@@ -0,0 +1,191 @@
+//go:build windows
+
+package wintray
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// ErrIconRectNotFound is returned by IconRect when Windows can't tell where the icon is,
+// e.g. because it's in the closed overflow flyout.
+var ErrIconRectNotFound = errors.New("tray icon rectangle not found")
+
+// Callback for display changes, protected by callbacksLock
+var displayChangeCallback func()
+
+// Set a callback to be called when a monitor is added or removed or the display resolution changes,
+// e.g. to reposition a popup shown next to the tray icon.
+// The callback runs on a new goroutine.
+func OnDisplayChange(f func()) {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	displayChangeCallback = f
+}
+
+// Handle a WM_DISPLAYCHANGE message.
+// https://learn.microsoft.com/en-us/windows/win32/gdi/wm-displaychange
+func (t *winTray) handleDisplayChange() {
+	callbacksLock.RLock()
+	f := displayChangeCallback
+	callbacksLock.RUnlock()
+	if f != nil {
+		go f()
+	}
+}
+
+// Edge of the screen.
+type ScreenEdge uint32
+
+// https://learn.microsoft.com/en-us/windows/win32/api/shellapi/ns-shellapi-appbardata
+const (
+	EdgeLeft   ScreenEdge = 0 // ABE_LEFT
+	EdgeTop    ScreenEdge = 1 // ABE_TOP
+	EdgeRight  ScreenEdge = 2 // ABE_RIGHT
+	EdgeBottom ScreenEdge = 3 // ABE_BOTTOM
+)
+
+// Return the edge of the screen the primary taskbar is docked to.
+// SHAppBarMessage: https://learn.microsoft.com/en-us/windows/win32/api/shellapi/nf-shellapi-shappbarmessage
+func TaskbarEdge() (ScreenEdge, error) {
+	const ABM_GETTASKBARPOS = 0x00000005
+	abd := appBarData{}
+	abd.Size = uint32(unsafe.Sizeof(abd))
+	res, _, _ := pSHAppBarMessage.Call(ABM_GETTASKBARPOS, uintptr(unsafe.Pointer(&abd)))
+	if res == 0 {
+		return 0, errors.New("taskbar not found")
+	}
+	return ScreenEdge(abd.Edge), nil
+}
+
+// Return the work area of the monitor nearest to the point, i.e. the monitor minus the taskbar.
+// GetMonitorInfo: https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-getmonitorinfow
+func workArea(p Point) (Rect, error) {
+	const MONITOR_DEFAULTTONEAREST = 0x00000002
+	r := Rect{Left: p.X, Top: p.Y, Right: p.X + 1, Bottom: p.Y + 1}
+	monitor, _, err := pMonitorFromRect.Call(uintptr(unsafe.Pointer(&r)), MONITOR_DEFAULTTONEAREST)
+	if monitor == 0 {
+		return Rect{}, err
+	}
+	mi := monitorInfo{}
+	mi.Size = uint32(unsafe.Sizeof(mi))
+	res, _, err := pGetMonitorInfo.Call(monitor, uintptr(unsafe.Pointer(&mi)))
+	if res == 0 {
+		return Rect{}, err
+	}
+	return mi.Work, nil
+}
+
+// Return the TrackPopupMenu flags aligning a menu shown at p so that it opens
+// away from the taskbar, toward the interior of the screen.
+func menuAlignment(p Point) uintptr {
+	const (
+		TPM_LEFTALIGN   = 0x0000
+		TPM_RIGHTALIGN  = 0x0008
+		TPM_TOPALIGN    = 0x0000
+		TPM_BOTTOMALIGN = 0x0020
+	)
+	area, err := workArea(p)
+	if err != nil {
+		// The usual bottom taskbar
+		return TPM_BOTTOMALIGN | TPM_LEFTALIGN
+	}
+	center := area.Center()
+	horizontal := uintptr(TPM_LEFTALIGN)
+	if p.X > center.X {
+		horizontal = TPM_RIGHTALIGN
+	}
+	vertical := uintptr(TPM_TOPALIGN)
+	if p.Y > center.Y {
+		vertical = TPM_BOTTOMALIGN
+	}
+	// Always open away from the taskbar, whichever half of the screen the point is in
+	if edge, err := TaskbarEdge(); err == nil {
+		switch edge {
+		case EdgeLeft:
+			horizontal = TPM_LEFTALIGN
+		case EdgeRight:
+			horizontal = TPM_RIGHTALIGN
+		case EdgeTop:
+			vertical = TPM_TOPALIGN
+		case EdgeBottom:
+			vertical = TPM_BOTTOMALIGN
+		}
+	}
+	return horizontal | vertical
+}
+
+// Return the window of the primary taskbar, or 0 if there's no taskbar.
+func taskbarWindow() windows.Handle {
+	classNamePtr, err := windows.UTF16PtrFromString("Shell_TrayWnd")
+	if err != nil {
+		return 0
+	}
+	res, _, _ := pFindWindow.Call(uintptr(unsafe.Pointer(classNamePtr)), 0)
+	return windows.Handle(res)
+}
+
+// Return the screen rectangle of the tray icon.
+// https://learn.microsoft.com/en-us/windows/win32/api/shellapi/nf-shellapi-shell_notifyicongetrect
+func IconRect() (Rect, error) {
+	const E_FAIL = 0x80004005
+	if !wt.isReady() {
+		return Rect{}, ErrTrayNotReadyYet
+	}
+	wt.muNID.Lock()
+	added := wt.iconAdded
+	nii := notifyIconIdentifier{Wnd: wt.nid.Wnd, ID: wt.nid.ID}
+	wt.muNID.Unlock()
+	if !added {
+		return Rect{}, errors.New("tray icon is hidden")
+	}
+	nii.Size = uint32(unsafe.Sizeof(nii))
+
+	var r Rect
+	res, _, _ := pShellNotifyIconGetRect.Call(
+		uintptr(unsafe.Pointer(&nii)),
+		uintptr(unsafe.Pointer(&r)),
+	)
+	if uint32(res) == E_FAIL {
+		return Rect{}, ErrIconRectNotFound
+	}
+	if res != 0 {
+		return Rect{}, fmt.Errorf("Shell_NotifyIconGetRect: HRESULT 0x%08X", uint32(res))
+	}
+	return r, nil
+}
+
+// Return whether the tray icon is in the overflow flyout ("Show hidden icons")
+// rather than in the always visible part of the notification area.
+// This is a best guess: Windows doesn't report it directly, so the icon is
+// considered overflowed if its rectangle can't be found or lies outside the taskbar.
+// Depending on the Windows version, an open flyout may also count as overflowed.
+func IsIconOverflowed() (bool, error) {
+	if !wt.isReady() {
+		return false, ErrTrayNotReadyYet
+	}
+	r, err := IconRect()
+	if err != nil {
+		if errors.Is(err, ErrIconRectNotFound) {
+			// Shell_NotifyIconGetRect fails for icons in the closed flyout
+			return true, nil
+		}
+		return false, err
+	}
+	if r.Width() <= 0 || r.Height() <= 0 {
+		return true, nil
+	}
+	taskbar := taskbarWindow()
+	if taskbar == 0 {
+		return false, errors.New("taskbar not found")
+	}
+	var tr Rect
+	res, _, err := pGetWindowRect.Call(uintptr(taskbar), uintptr(unsafe.Pointer(&tr)))
+	if res == 0 {
+		return false, err
+	}
+	return !tr.Contains(r.Center()), nil
+}
@@ -0,0 +1,132 @@
+//go:build windows
+
+package wintray
+
+import "syscall"
+
+var (
+	// Callbacks for sleep and resume, protected by callbacksLock
+	suspendCallback func()
+	resumeCallback  func()
+	// Callbacks for session changes, protected by callbacksLock
+	sessionLockCallback   func()
+	sessionUnlockCallback func()
+	sessionLogonCallback  func()
+	sessionLogoffCallback func()
+)
+
+// Set a callback to be called when the system is about to sleep or hibernate.
+// The callback runs on a new goroutine, so it may not finish before the system sleeps.
+func OnSuspend(f func()) {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	suspendCallback = f
+}
+
+// Set a callback to be called when the system has resumed from sleep or hibernation.
+// The callback runs on a new goroutine.
+func OnResume(f func()) {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	resumeCallback = f
+}
+
+// Handle a WM_POWERBROADCAST message.
+// https://learn.microsoft.com/en-us/windows/win32/power/wm-powerbroadcast
+func (t *winTray) handlePowerBroadcast(event uintptr) {
+	const (
+		PBT_APMSUSPEND         = 0x0004
+		PBT_APMRESUMEAUTOMATIC = 0x0012
+	)
+	callbacksLock.RLock()
+	var f func()
+	switch event {
+	case PBT_APMSUSPEND:
+		f = suspendCallback
+	case PBT_APMRESUMEAUTOMATIC:
+		f = resumeCallback
+	}
+	callbacksLock.RUnlock()
+	if f != nil {
+		go f()
+	}
+}
+
+// Set a callback to be called when the workstation is locked.
+// The callback runs on a new goroutine.
+func OnSessionLock(f func()) {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	sessionLockCallback = f
+}
+
+// Set a callback to be called when the workstation is unlocked.
+// The callback runs on a new goroutine.
+func OnSessionUnlock(f func()) {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	sessionUnlockCallback = f
+}
+
+// Set a callback to be called when a user logs on to the session, e.g. through Remote Desktop.
+// The callback runs on a new goroutine.
+func OnSessionLogon(f func()) {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	sessionLogonCallback = f
+}
+
+// Set a callback to be called when the user logs off the session.
+// The callback runs on a new goroutine.
+func OnSessionLogoff(f func()) {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	sessionLogoffCallback = f
+}
+
+// Ask for WM_WTSSESSION_CHANGE messages about the current session.
+// https://learn.microsoft.com/en-us/windows/win32/api/wtsapi32/nf-wtsapi32-wtsregistersessionnotification
+func (t *winTray) registerSessionNotification() {
+	const NOTIFY_FOR_THIS_SESSION = 0
+	res, _, err := pWTSRegisterSessionNotification.Call(uintptr(t.window), NOTIFY_FOR_THIS_SESSION)
+	if res == 0 {
+		logf("systray error: failed to register for session notifications: %s\n", err)
+	}
+}
+
+// Stop the WM_WTSSESSION_CHANGE messages.
+// https://learn.microsoft.com/en-us/windows/win32/api/wtsapi32/nf-wtsapi32-wtsunregistersessionnotification
+func (t *winTray) unregisterSessionNotification() {
+	const ERROR_SUCCESS syscall.Errno = 0
+	res, _, err := pWTSUnRegisterSessionNotification.Call(uintptr(t.window))
+	if res == 0 && err.(syscall.Errno) != ERROR_SUCCESS {
+		logf("systray error: failed to unregister session notifications: %s\n", err)
+	}
+}
+
+// Handle a WM_WTSSESSION_CHANGE message.
+// https://learn.microsoft.com/en-us/windows/win32/termserv/wm-wtssession-change
+func (t *winTray) handleSessionChange(event uintptr) {
+	const (
+		WTS_SESSION_LOGON  = 0x5
+		WTS_SESSION_LOGOFF = 0x6
+		WTS_SESSION_LOCK   = 0x7
+		WTS_SESSION_UNLOCK = 0x8
+	)
+	callbacksLock.RLock()
+	var f func()
+	switch event {
+	case WTS_SESSION_LOGON:
+		f = sessionLogonCallback
+	case WTS_SESSION_LOGOFF:
+		f = sessionLogoffCallback
+	case WTS_SESSION_LOCK:
+		f = sessionLockCallback
+	case WTS_SESSION_UNLOCK:
+		f = sessionUnlockCallback
+	}
+	callbacksLock.RUnlock()
+	if f != nil {
+		go f()
+	}
+}
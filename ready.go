@@ -0,0 +1,90 @@
+//go:build windows
+
+package wintray
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	// Closed when the tray has been initialized
+	readyCh   = make(chan struct{})
+	readyOnce sync.Once
+	// Closed when the message loop has exited after the tray window was destroyed
+	doneCh   = make(chan struct{})
+	doneOnce sync.Once
+)
+
+// Mark the tray as ready and wake up the functions waiting for it.
+func setReady() {
+	wt.initialized.Store(true)
+	readyOnce.Do(func() { close(readyCh) })
+}
+
+// Mark the tray as gone and wake up the functions waiting for it.
+// Called when the message loop exits, after onExit has returned.
+func setDone() {
+	doneOnce.Do(func() { close(doneCh) })
+}
+
+// Return a channel that is closed once the tray window has been destroyed after Quit
+// and onExit has returned, i.e. the message loop has handled its last message and exited.
+// Only the loops of Run, RunWith, MessagePump and PumpOnce close it, not a loop
+// run by the application after Register.
+func Done() <-chan struct{} {
+	return doneCh
+}
+
+// Quit and wait for the tray window to be destroyed, or until ctx is done.
+// Unlike Quit, it returns an error if the message loop didn't finish in time,
+// e.g. because it isn't running anymore.
+// It must not be called from the message loop thread, e.g. from OnTrayOpened callbacks.
+func Shutdown(ctx context.Context) error {
+	if !wt.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	if windows.GetCurrentThreadId() == wt.threadID {
+		return errors.New("Shutdown cannot be called from the message loop thread")
+	}
+	Quit()
+	select {
+	case <-doneCh:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("message loop didn't exit: %w", ctx.Err())
+	}
+}
+
+// Return whether the tray has been initialized, so that menu items can be added.
+func Ready() bool {
+	return wt.isReady()
+}
+
+// Block until the tray has been initialized or ctx is done.
+func WaitReady(ctx context.Context) error {
+	select {
+	case <-readyCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Like AddMenuItem, but waits for the tray to be initialized first and returns
+// an error if the menu item couldn't be added.
+// Useful for goroutines that set up the menu concurrently with Run.
+func AddMenuItemWait(ctx context.Context, title string) (*MenuItem, error) {
+	if err := WaitReady(ctx); err != nil {
+		return nil, err
+	}
+	item := newMenuItem(title, nil)
+	if err := item.add(); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
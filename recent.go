@@ -0,0 +1,97 @@
+//go:build windows
+
+package wintray
+
+import "sync"
+
+// RecentItemsMenu maintains a capped list of submenu items, such as a "Recent Files" menu.
+// The most recently pushed item is shown first.
+// Don't create it directly, use NewRecentItemsMenu()
+type RecentItemsMenu struct {
+	mu sync.Mutex
+	// Menu item whose submenu holds the recent items
+	parent *MenuItem
+	// Maximum number of items shown
+	limit int
+	// Titles and callbacks of the recent items, newest first
+	entries []recentEntry
+	// Menu items used to display the entries, in menu order
+	slots []*MenuItem
+}
+
+// A title and callback pushed onto a RecentItemsMenu.
+type recentEntry struct {
+	title string
+	cb    func()
+}
+
+// Create a RecentItemsMenu showing up to limit items in the submenu of parent.
+// The submenu should not contain other items, as they would be interleaved with the recent items.
+func NewRecentItemsMenu(parent *MenuItem, limit int) *RecentItemsMenu {
+	if limit < 1 {
+		limit = 1
+	}
+	return &RecentItemsMenu{parent: parent, limit: limit}
+}
+
+// Add an item to the top of the list, evicting the oldest item if the list is full.
+// The callback is called from a new goroutine when the item is clicked.
+func (r *RecentItemsMenu) Push(title string, cb func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append([]recentEntry{{title, cb}}, r.entries...)
+	if len(r.entries) > r.limit {
+		r.entries = r.entries[:r.limit]
+	}
+	r.refresh()
+}
+
+// Remove all items from the list.
+func (r *RecentItemsMenu) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = nil
+	r.refresh()
+}
+
+// Return the number of items in the list.
+func (r *RecentItemsMenu) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.entries)
+}
+
+// Change the maximum number of items, evicting the oldest items if needed.
+func (r *RecentItemsMenu) SetLimit(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limit = limit
+	if len(r.entries) > r.limit {
+		r.entries = r.entries[:r.limit]
+	}
+	r.refresh()
+}
+
+// Make the menu items match the entries, adding or removing items as needed.
+// Existing items are reused so that the newest entry always stays at the top
+// regardless of the order in which the items were created.
+func (r *RecentItemsMenu) refresh() {
+	for len(r.slots) > len(r.entries) {
+		last := len(r.slots) - 1
+		r.slots[last].Remove()
+		r.slots = r.slots[:last]
+	}
+	for i, entry := range r.entries {
+		if i < len(r.slots) {
+			r.slots[i].SetCallback(entry.cb)
+			r.slots[i].SetTitle(entry.title)
+		} else {
+			item := r.parent.AddSubMenuItem(entry.title)
+			item.SetCallback(entry.cb)
+			r.slots = append(r.slots, item)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+//go:build windows
+
+package wintray
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Show a reason to the user when Windows is shutting down or logging off,
+// and ask it to wait before ending the session, e.g. while a sync is in progress.
+// Call ClearShutdownBlockReason when the work is done.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-shutdownblockreasoncreate
+func SetShutdownBlockReason(reason string) error {
+	reasonPtr, err := windows.UTF16PtrFromString(reason)
+	if err != nil {
+		return err
+	}
+	return wt.runOnLoop(func() error {
+		res, _, err := pShutdownBlockReasonCreate.Call(
+			uintptr(wt.window),
+			uintptr(unsafe.Pointer(reasonPtr)),
+		)
+		if res == 0 {
+			return err
+		}
+		return nil
+	})
+}
+
+// Allow Windows to end the session without waiting again.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/nf-winuser-shutdownblockreasondestroy
+func ClearShutdownBlockReason() {
+	err := wt.runOnLoop(func() error {
+		res, _, err := pShutdownBlockReasonDestroy.Call(uintptr(wt.window))
+		if res == 0 {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		logf("systray error: failed to clear shutdown block reason: %s\n", err)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build windows
+
+package wintray
+
+import "golang.org/x/sys/windows"
+
+// Add a menu item that opens a URL in the default browser when clicked.
+func AddMenuItemURL(title, url string) *MenuItem {
+	return addMenuItemOpen(title, url)
+}
+
+// Add a menu item that opens a file or folder with its default handler when clicked,
+// e.g. a log file or the application's data folder.
+func AddMenuItemPath(title, path string) *MenuItem {
+	return addMenuItemOpen(title, path)
+}
+
+// Add a menu item that opens target with ShellExecute when clicked.
+func addMenuItemOpen(title, target string) *MenuItem {
+	item := AddMenuItem(title)
+	item.SetCallback(func() {
+		if err := shellOpen(target); err != nil {
+			logf("systray error: failed to open %s: %s\n", target, err)
+		}
+	})
+	return item
+}
+
+// Open a URL or path with its default handler.
+// ShellExecute: https://learn.microsoft.com/en-us/windows/win32/api/shellapi/nf-shellapi-shellexecutew
+func shellOpen(target string) error {
+	const SW_SHOWNORMAL = 1
+	verbPtr, err := windows.UTF16PtrFromString("open")
+	if err != nil {
+		return err
+	}
+	targetPtr, err := windows.UTF16PtrFromString(target)
+	if err != nil {
+		return err
+	}
+	return windows.ShellExecute(0, verbPtr, targetPtr, nil, nil, SW_SHOWNORMAL)
+}
@@ -0,0 +1,99 @@
+//go:build windows
+
+package wintray
+
+import "fmt"
+
+// MenuSpec describes a menu item and its submenu, e.g. as loaded from JSON or YAML.
+type MenuSpec struct {
+	// Key used to look up the created menu item, e.g. to attach a callback; optional
+	ID string `json:"id,omitempty" yaml:"id,omitempty"`
+	// The text shown on the menu item
+	Title string `json:"title,omitempty" yaml:"title,omitempty"`
+	// Whether or not the menu item is checked
+	Checked bool `json:"checked,omitempty" yaml:"checked,omitempty"`
+	// Whether or not the menu item is a toggle, even while unchecked; implied by Checked
+	Checkable bool `json:"checkable,omitempty" yaml:"checkable,omitempty"`
+	// Whether or not the menu item is disabled
+	Disabled bool `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+	// Whether or not the menu item is hidden
+	Hidden bool `json:"hidden,omitempty" yaml:"hidden,omitempty"`
+	// Whether this is a separator bar rather than a menu item
+	Separator bool `json:"separator,omitempty" yaml:"separator,omitempty"`
+	// Items of the submenu, if any
+	Children []MenuSpec `json:"children,omitempty" yaml:"children,omitempty"`
+}
+
+// Add the children of spec to the menu, including their submenus.
+// The spec itself stands for the menu, so its other fields are ignored.
+// Returns the created menu items keyed by their ID, for attaching callbacks.
+// Call ResetMenu first to replace the current menu.
+func BuildMenuFromSpec(spec MenuSpec) (map[string]*MenuItem, error) {
+	if !wt.isReady() {
+		return nil, ErrTrayNotReadyYet
+	}
+	// Check the whole spec first, so that a mistake doesn't leave half a menu
+	if err := checkMenuSpecChildren(spec.Children, make(map[string]bool)); err != nil {
+		return nil, err
+	}
+	items := make(map[string]*MenuItem)
+	if err := buildMenuSpecChildren(spec.Children, nil, items); err != nil {
+		return items, err
+	}
+	return items, nil
+}
+
+// Check the menu items described by specs and their submenus for duplicate IDs
+// and separators with children. ids holds the IDs seen so far.
+func checkMenuSpecChildren(specs []MenuSpec, ids map[string]bool) error {
+	for _, spec := range specs {
+		if spec.Separator {
+			if len(spec.Children) > 0 {
+				return fmt.Errorf("separator %q cannot have children", spec.ID)
+			}
+			continue
+		}
+		if spec.ID != "" {
+			if ids[spec.ID] {
+				return fmt.Errorf("duplicate menu item ID %q", spec.ID)
+			}
+			ids[spec.ID] = true
+		}
+		if err := checkMenuSpecChildren(spec.Children, ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add the menu items described by specs to the submenu of parent, or to the menu if parent is nil.
+func buildMenuSpecChildren(specs []MenuSpec, parent *MenuItem, items map[string]*MenuItem) error {
+	for _, spec := range specs {
+		if spec.Separator {
+			item := newMenuItem("", parent)
+			item.separator = true
+			item.hidden = spec.Hidden
+			if err := item.add(); err != nil {
+				return err
+			}
+			continue
+		}
+		item := newMenuItem(spec.Title, parent)
+		item.checked = spec.Checked
+		item.checkable = spec.Checkable || spec.Checked
+		item.disabled = spec.Disabled
+		// Hidden items are never inserted, rather than shown and removed again
+		item.hidden = spec.Hidden
+		item.specID = spec.ID
+		if err := item.add(); err != nil {
+			return err
+		}
+		if spec.ID != "" {
+			items[spec.ID] = item
+		}
+		if err := buildMenuSpecChildren(spec.Children, item, items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
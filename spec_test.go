@@ -0,0 +1,84 @@
+//go:build windows
+
+package wintray
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMenuSpecCheckable(t *testing.T) {
+	root := resetMenu(t)
+	items, err := BuildMenuFromSpec(MenuSpec{Children: []MenuSpec{
+		{ID: "toggle", Title: "Toggle", Checkable: true},
+		{ID: "checked", Title: "Checked", Checked: true},
+		{ID: "plain", Title: "Plain"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMenu(t, root, nil, items["toggle"], items["checked"], items["plain"])
+	for id, want := range map[string]bool{"toggle": true, "checked": true, "plain": false} {
+		items[id].mu.RLock()
+		checkable := items[id].checkable
+		items[id].mu.RUnlock()
+		if checkable != want {
+			t.Errorf("item %q checkable = %v, want %v", id, checkable, want)
+		}
+	}
+
+	// The unchecked toggle stays checkable when the menu is saved and restored
+	data, err := ExportMenuState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec MenuSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Children) != 3 || !spec.Children[0].Checkable || spec.Children[0].Checked {
+		t.Errorf("exported spec lost the toggle: %+v", spec.Children)
+	}
+}
+
+func TestMenuSpecDuplicateID(t *testing.T) {
+	root := resetMenu(t)
+	// The duplicate is found before any item is created
+	_, err := BuildMenuFromSpec(MenuSpec{Children: []MenuSpec{
+		{ID: "a", Title: "A"},
+		{Title: "Sub", Children: []MenuSpec{{ID: "a", Title: "A again"}}},
+	}})
+	if err == nil {
+		t.Fatal("no error for a duplicate ID")
+	}
+	checkMenu(t, root, nil)
+}
+
+func TestMenuSpecHidden(t *testing.T) {
+	root := resetMenu(t)
+	resetHeadlessHistory()
+	items, err := BuildMenuFromSpec(MenuSpec{Children: []MenuSpec{
+		{ID: "shown", Title: "Shown"},
+		{ID: "hidden", Title: "Hidden", Hidden: true, Children: []MenuSpec{
+			{ID: "child", Title: "Child"},
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, call := range headlessHistory() {
+		if call.Name == "RemoveMenu" {
+			t.Errorf("hidden item %d was inserted and removed again", call.ID)
+		}
+	}
+	checkMenu(t, root, nil, items["shown"])
+
+	// The submenu is attached when the item is shown
+	items["hidden"].Show()
+	checkMenu(t, root, nil, items["shown"], items["hidden"])
+	sub := subMenu(items["hidden"])
+	if got := testMenus.item(t, root, items["hidden"].id).SubMenu; sub == 0 || got != sub {
+		t.Fatalf("item shows submenu %d, want %d", got, sub)
+	}
+	checkMenu(t, sub, items["hidden"], items["child"])
+}
@@ -0,0 +1,151 @@
+//go:build windows
+
+package wintray
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Return the current menu as JSON, e.g. to restore it with ImportMenuState after a restart.
+// The titles, states and hierarchy of the menu items are saved, but not their callbacks or icons.
+// Menu items built from a MenuSpec keep their ID, the others are given their internal ID.
+func ExportMenuState() ([]byte, error) {
+	if !wt.isReady() {
+		return nil, ErrTrayNotReadyYet
+	}
+	children := make(map[uint32][]uint32)
+	menuItemsLock.RLock()
+	items := make(map[uint32]*MenuItem, len(menuItems))
+	for id, item := range menuItems {
+		items[id] = item
+		children[item.parentId()] = append(children[item.parentId()], id)
+	}
+	menuItemsLock.RUnlock()
+
+	visible := make(map[uint32]bool)
+	wt.muVisibleItems.RLock()
+	for _, ids := range wt.visibleItems {
+		for _, id := range ids {
+			visible[id] = true
+		}
+	}
+	wt.muVisibleItems.RUnlock()
+
+	var build func(parent uint32) []MenuSpec
+	build = func(parent uint32) []MenuSpec {
+		ids := children[parent]
+		// Menu items are always shown in the order they were created
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		specs := make([]MenuSpec, 0, len(ids))
+		for _, id := range ids {
+			item := items[id]
+			if item.separator {
+				specs = append(specs, MenuSpec{Separator: true, Hidden: !visible[id]})
+				continue
+			}
+			item.mu.RLock()
+			spec := MenuSpec{
+				ID:        item.specID,
+				Title:     item.title,
+				Checked:   item.checked,
+				Checkable: item.checkable,
+				Disabled:  item.disabled,
+				Hidden:    !visible[id],
+			}
+			item.mu.RUnlock()
+			spec.Children = build(id)
+			if spec.ID == "" {
+				spec.ID = strconv.FormatUint(uint64(id), 10)
+			}
+			specs = append(specs, spec)
+		}
+		return specs
+	}
+	return json.Marshal(MenuSpec{Children: build(0)})
+}
+
+// Replace the menu with one saved by ExportMenuState.
+// Returns the created menu items keyed by their ID, for attaching callbacks.
+func ImportMenuState(data []byte) (map[string]*MenuItem, error) {
+	var spec MenuSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse menu state: %w", err)
+	}
+	if !wt.isReady() {
+		return nil, ErrTrayNotReadyYet
+	}
+	ResetMenu()
+	return BuildMenuFromSpec(spec)
+}
+
+// MenuItemState is a snapshot of the state of a menu item.
+type MenuItemState struct {
+	// Internal ID of the menu item
+	ID uint32
+	// ID of the parent menu item, or 0 for items of the main menu
+	ParentID uint32
+	Title    string
+	Checked  bool
+	Disabled bool
+	// Whether or not the menu item is in its menu, i.e. it's neither hidden nor removed
+	Visible bool
+	// Whether or not items have been added to the submenu of the menu item
+	HasSubMenu bool
+}
+
+// Return the state of the menu item, read in one critical section rather than
+// through separate calls that may interleave with changes.
+// Visible and HasSubMenu reflect the menu itself, which a concurrent Hide, Show
+// or Remove updates just after changing the item.
+func (item *MenuItem) State() MenuItemState {
+	item.mu.RLock()
+	defer item.mu.RUnlock()
+	state := MenuItemState{
+		ID:       item.id,
+		Title:    item.title,
+		Checked:  item.checked,
+		Disabled: item.disabled,
+	}
+	if item.parent != nil {
+		state.ParentID = item.parent.id
+	}
+	state.Visible = wt.getVisibleItemIndex(state.ParentID, item.id) != -1
+	state.HasSubMenu = item.HasSubMenu()
+	return state
+}
+
+// Check or uncheck many menu items at once, e.g. to reflect a settings struct.
+// The items are updated together on the message loop thread, so an open menu
+// doesn't show them changing one by one. Items already in the given state are skipped.
+func ApplyStates(states map[*MenuItem]bool) {
+	changed := make([]*MenuItem, 0, len(states))
+	for item, checked := range states {
+		item.mu.Lock()
+		if item.checked != checked || !item.checkable {
+			item.checked = checked
+			item.checkable = true
+			changed = append(changed, item)
+		}
+		item.mu.Unlock()
+	}
+	if len(changed) == 0 {
+		return
+	}
+	menuItemsLock.Lock()
+	for _, item := range changed {
+		menuItems[item.id] = item
+	}
+	menuItemsLock.Unlock()
+	err := wt.runOnLoop(func() error {
+		for _, item := range changed {
+			addOrUpdateMenuItem(item)
+		}
+		return nil
+	})
+	if err != nil {
+		logf("systray error: unable to apply menu item states: %s\n", err)
+	}
+}
@@ -3,6 +3,7 @@
 package wintray
 
 import (
+	"unicode/utf16"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
@@ -32,6 +33,23 @@ type bitmapInfoHeader struct {
 	BiClrImportant  uint32
 }
 
+// Contains information about an icon or a cursor.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/ns-winuser-iconinfo
+type iconInfo struct {
+	Icon               int32
+	XHotspot, YHotspot uint32
+	Mask, Color        windows.Handle
+}
+
+// Contains information about a menu.
+// https://msdn.microsoft.com/en-us/library/windows/desktop/ms647575(v=vs.85).aspx
+type menuInfo struct {
+	Size, Mask, Style, Max uint32
+	Background             windows.Handle
+	ContextHelpID          uint32
+	MenuData               uintptr
+}
+
 // Contains information about a menu item.
 // https://msdn.microsoft.com/en-us/library/windows/desktop/ms647578(v=vs.85).aspx
 type menuItemInfo struct {
@@ -56,17 +74,23 @@ type notifyIconData struct {
 	Tip                        [128]uint16
 	State, StateMask           uint32
 	Info                       [256]uint16
-	Timeout, Version           uint32
+	Version                    uint32 // union with the deprecated uTimeout
 	InfoTitle                  [64]uint16
 	InfoFlags                  uint32
 	GuidItem                   windows.GUID
 	BalloonIcon                windows.Handle
 }
 
-func (nid *notifyIconData) add() error {
-	const NIM_ADD = 0x00000000
+// Send a message about the icon to the notification area.
+// In headless mode, the message is only recorded.
+// https://learn.microsoft.com/en-us/windows/win32/api/shellapi/nf-shellapi-shell_notifyiconw
+func (nid *notifyIconData) send(message uint32) error {
+	if headless.Load() {
+		recordHeadless("Shell_NotifyIcon", 0, message)
+		return nil
+	}
 	res, _, err := pShellNotifyIcon.Call(
-		uintptr(NIM_ADD),
+		uintptr(message),
 		uintptr(unsafe.Pointer(nid)),
 	)
 	if res == 0 {
@@ -75,36 +99,150 @@ func (nid *notifyIconData) add() error {
 	return nil
 }
 
-func (nid *notifyIconData) modify() error {
-	const NIM_MODIFY = 0x00000001
-	res, _, err := pShellNotifyIcon.Call(
-		uintptr(NIM_MODIFY),
-		uintptr(unsafe.Pointer(nid)),
-	)
-	if res == 0 {
+// Add the icon to the notification area and, if set, apply the version.
+func (nid *notifyIconData) add() error {
+	const NIM_ADD = 0x00000000
+	if err := nid.send(NIM_ADD); err != nil {
 		return err
 	}
+	if nid.Version != 0 {
+		return nid.setVersion()
+	}
 	return nil
 }
 
-func (nid *notifyIconData) delete() error {
-	const NIM_DELETE = 0x00000002
-	res, _, err := pShellNotifyIcon.Call(
-		uintptr(NIM_DELETE),
-		uintptr(unsafe.Pointer(nid)),
-	)
-	if res == 0 {
+// Instruct the notification area to behave according to nid.Version.
+func (nid *notifyIconData) setVersion() error {
+	const NIM_SETVERSION = 0x00000004
+	return nid.send(NIM_SETVERSION)
+}
+
+// Set the tooltip text, truncating it with an ellipsis if it doesn't fit.
+func (nid *notifyIconData) setTip(tip string) error {
+	return setNIDText(nid.Tip[:], tip)
+}
+
+// Copy text into a fixed size buffer of notifyIconData, truncating it with an ellipsis if it doesn't fit.
+func setNIDText(buf []uint16, text string) error {
+	b, err := windows.UTF16FromString(text)
+	if err != nil {
 		return err
 	}
+	b = truncateUTF16(b[:len(b)-1], len(buf)-1)
+	n := copy(buf, b)
+	buf[n] = 0
 	return nil
 }
 
-// Defines the x and y coordinates of a point.
+func (nid *notifyIconData) modify() error {
+	const NIM_MODIFY = 0x00000001
+	return nid.send(NIM_MODIFY)
+}
+
+func (nid *notifyIconData) delete() error {
+	const NIM_DELETE = 0x00000002
+	return nid.send(NIM_DELETE)
+}
+
+// Return the keyboard focus to the notification area.
+func (nid *notifyIconData) setFocus() error {
+	const NIM_SETFOCUS = 0x00000003
+	return nid.send(NIM_SETFOCUS)
+}
+
+// Contains message information from a thread's message queue.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/ns-winuser-msg
+type msg struct {
+	WindowHandle windows.Handle
+	Message      uint32
+	Wparam       uintptr
+	Lparam       uintptr
+	Time         uint32
+	Pt           Point
+}
+
+// Shorten UTF-16 text to at most n units, ending with an ellipsis if it was
+// truncated. Surrogate pairs are never split.
+func truncateUTF16(s []uint16, n int) []uint16 {
+	const ellipsis = 0x2026
+	if len(s) <= n {
+		return s
+	}
+	if n < 1 {
+		return s[:0]
+	}
+	end := n - 1
+	if end > 0 && utf16.IsSurrogate(rune(s[end-1])) && s[end-1] < 0xDC00 {
+		// Don't leave a dangling high surrogate
+		end--
+	}
+	return append(s[:end:end], ellipsis)
+}
+
+// Defines the x and y coordinates of a point, in screen coordinates.
+// Same layout as the Win32 POINT structure.
 // https://msdn.microsoft.com/en-us/library/windows/desktop/dd162805(v=vs.85).aspx
-type point struct {
+type Point struct {
 	X, Y int32
 }
 
+// Defines a rectangle by its upper-left and lower-right corners, in screen coordinates.
+// Same layout as the Win32 RECT structure.
+// https://learn.microsoft.com/en-us/windows/win32/api/windef/ns-windef-rect
+type Rect struct {
+	Left, Top, Right, Bottom int32
+}
+
+// Return the width of the rectangle.
+func (r Rect) Width() int32 {
+	return r.Right - r.Left
+}
+
+// Return the height of the rectangle.
+func (r Rect) Height() int32 {
+	return r.Bottom - r.Top
+}
+
+// Return the center of the rectangle.
+func (r Rect) Center() Point {
+	return Point{X: r.Left + r.Width()/2, Y: r.Top + r.Height()/2}
+}
+
+// Return whether the point lies in the rectangle.
+// Like PtInRect, the right and bottom edges are not part of the rectangle.
+func (r Rect) Contains(p Point) bool {
+	return p.X >= r.Left && p.X < r.Right && p.Y >= r.Top && p.Y < r.Bottom
+}
+
+// Identifies a tray icon for Shell_NotifyIconGetRect.
+// https://learn.microsoft.com/en-us/windows/win32/api/shellapi/ns-shellapi-notifyiconidentifier
+type notifyIconIdentifier struct {
+	Size     uint32
+	Wnd      windows.Handle
+	ID       uint32
+	GuidItem windows.GUID
+}
+
+// Contains information about an appbar such as the taskbar.
+// https://learn.microsoft.com/en-us/windows/win32/api/shellapi/ns-shellapi-appbardata
+type appBarData struct {
+	Size            uint32
+	Wnd             windows.Handle
+	CallbackMessage uint32
+	Edge            uint32
+	Rect            Rect
+	LParam          uintptr
+}
+
+// Contains information about a display monitor.
+// https://learn.microsoft.com/en-us/windows/win32/api/winuser/ns-winuser-monitorinfo
+type monitorInfo struct {
+	Size    uint32
+	Monitor Rect
+	Work    Rect
+	Flags   uint32
+}
+
 // Contains window class information.
 // Used with the RegisterClassEx and GetClassInfoEx functions.
 // https://msdn.microsoft.com/en-us/library/ms633577.aspx
@@ -0,0 +1,59 @@
+//go:build windows
+
+package wintray
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Show a square of solid color as the icon of the menu item, e.g. for choosing a theme color.
+func (item *MenuItem) SetColorSwatch(r, g, b uint8) error {
+	if !wt.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	h, err := swatchBitmap(r, g, b)
+	if err != nil {
+		return fmt.Errorf("failed to draw color swatch: %w", err)
+	}
+	return item.setIconBitmap(h, func() (windows.Handle, error) { return swatchBitmap(r, g, b) })
+}
+
+// Create a menu item bitmap filled with the color, with a gray border
+// so that colors close to the menu background remain visible.
+func swatchBitmap(r, g, b uint8) (windows.Handle, error) {
+	const SM_CXSMICON = 49
+	const SM_CYSMICON = 50
+	// Premultiplied BGRA
+	const borderColor = 0xFF808080
+	color := 0xFF000000 | uint32(r)<<16 | uint32(g)<<8 | uint32(b)
+
+	hDC, _, err := pGetDC.Call(uintptr(0))
+	if hDC == 0 {
+		return 0, err
+	}
+	defer pReleaseDC.Call(uintptr(0), hDC)
+	cx, _, _ := pGetSystemMetrics.Call(SM_CXSMICON)
+	cy, _, _ := pGetSystemMetrics.Call(SM_CYSMICON)
+	hBmp, bits, err := create32BitHBitmap(hDC, int32(cx), int32(cy))
+	if err != nil {
+		return 0, err
+	}
+
+	w, h := int(cx), int(cy)
+	pixels := unsafe.Slice((*uint32)(bits), w*h)
+	// Leave a transparent margin like regular icons have
+	margin := w / 8
+	for y := margin; y < h-margin; y++ {
+		for x := margin; x < w-margin; x++ {
+			c := color
+			if x == margin || y == margin || x == w-margin-1 || y == h-margin-1 {
+				c = borderColor
+			}
+			pixels[y*w+x] = c
+		}
+	}
+	return windows.Handle(hBmp), nil
+}
@@ -0,0 +1,67 @@
+//go:build windows
+
+package wintray
+
+import "testing"
+
+func TestRadioItemHidesIcon(t *testing.T) {
+	const MFT_RADIOCHECK = 0x00000200
+	root := resetMenu(t)
+	item := AddMenuItem("Item")
+	if err := item.SetColorSwatch(0, 128, 255); err != nil {
+		t.Fatal(err)
+	}
+	bitmap := testMenus.item(t, root, item.id).Bitmap
+	if bitmap == 0 {
+		t.Fatal("no bitmap shown for the color swatch")
+	}
+
+	// The bitmap would be drawn instead of the radio dot
+	item.SetRadio(true)
+	shown := testMenus.item(t, root, item.id)
+	if shown.Bitmap != 0 {
+		t.Error("radio item shows a bitmap")
+	}
+	if shown.Type&MFT_RADIOCHECK == 0 {
+		t.Error("radio item not shown with a radio dot")
+	}
+
+	item.SetRadio(false)
+	shown = testMenus.item(t, root, item.id)
+	if shown.Bitmap != bitmap {
+		t.Errorf("item shows bitmap %d after SetRadio(false), want %d", shown.Bitmap, bitmap)
+	}
+	if shown.Type&MFT_RADIOCHECK != 0 {
+		t.Error("item still shown with a radio dot")
+	}
+}
+
+func TestSubMenuParentKeepsIcon(t *testing.T) {
+	root := resetMenu(t)
+	parent := AddMenuItem("Parent")
+	if err := parent.SetColorSwatch(255, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	bitmap := testMenus.item(t, root, parent.id).Bitmap
+	child := parent.AddSubMenuItem("Child")
+	sub := subMenu(parent)
+
+	check := func(when string) {
+		t.Helper()
+		shown := testMenus.item(t, root, parent.id)
+		if shown.SubMenu != sub {
+			t.Errorf("%s: parent shows submenu %d, want %d", when, shown.SubMenu, sub)
+		}
+		if shown.Bitmap != bitmap {
+			t.Errorf("%s: parent shows bitmap %d, want %d", when, shown.Bitmap, bitmap)
+		}
+	}
+	check("after adding a child")
+	parent.SetTitle("Parent 2")
+	parent.Check()
+	check("after updating the parent")
+	parent.Hide()
+	parent.Show()
+	check("after showing the parent again")
+	checkMenu(t, sub, parent, child)
+}
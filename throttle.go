@@ -0,0 +1,53 @@
+//go:build windows
+
+package wintray
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Minimum time between updates of the tray icon, or 0 to apply them right away
+var updateThrottle atomic.Int64
+
+// Limit how often changes of the icon and tooltip are sent to the taskbar.
+// The first change is applied right away, and later changes within the interval
+// are coalesced so that only the latest state is applied when the interval ends.
+// This also slows down icon animations. The default of 0 applies every change.
+func SetUpdateThrottle(d time.Duration) {
+	updateThrottle.Store(int64(d))
+}
+
+// Apply the changes to nid now, or when the throttle interval ends.
+// Must be called with muNID locked.
+func (t *winTray) throttleModify(d time.Duration) error {
+	if t.modifyTimer != nil {
+		t.modifyPending = true
+		return nil
+	}
+	t.modifyTimer = time.AfterFunc(d, func() { t.flushModify(d) })
+	return t.nid.modify()
+}
+
+// Apply the changes coalesced by throttleModify, if any, on the message loop thread.
+func (t *winTray) flushModify(d time.Duration) {
+	err := t.runOnLoop(func() error {
+		t.muNID.Lock()
+		defer t.muNID.Unlock()
+		if !t.modifyPending {
+			t.modifyTimer = nil
+			return nil
+		}
+		t.modifyPending = false
+		t.modifyTimer = time.AfterFunc(d, func() { t.flushModify(d) })
+		if !t.iconAdded {
+			return nil
+		}
+		return t.nid.modify()
+	})
+	// After Quit, the icon is going away anyway
+	if err != nil && !errors.Is(err, ErrTrayQuitting) {
+		logf("systray error: failed to apply throttled icon update: %s\n", err)
+	}
+}
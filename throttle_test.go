@@ -0,0 +1,25 @@
+//go:build windows
+
+package wintray
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestThrottleFlushAfterQuit(t *testing.T) {
+	var logged bytes.Buffer
+	SetLogger(log.New(&logged, "", 0))
+	defer SetLogger(log.New(io.Discard, "", 0))
+
+	// A flush pending when Quit is called runs after it
+	quitting.Store(true)
+	wt.flushModify(time.Millisecond)
+	quitting.Store(false)
+	if logged.Len() != 0 {
+		t.Errorf("flush after Quit logged %q", logged.String())
+	}
+}
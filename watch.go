@@ -0,0 +1,115 @@
+//go:build windows
+
+package wintray
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// How often watched icon files are checked for changes
+const iconWatchInterval = 500 * time.Millisecond
+
+var (
+	// Stop functions of the running icon file watchers, by watcher ID
+	iconWatchers     = make(map[uint32]func())
+	iconWatchersLock sync.Mutex
+	iconWatcherID    uint32
+)
+
+// Set the tray icon from a file and apply it again whenever the file changes,
+// e.g. when it's regenerated by another process.
+// Call the returned function to stop watching; watching also stops on Quit.
+func WatchIconFile(path string) (stop func(), err error) {
+	if !wt.isReady() {
+		return nil, ErrTrayNotReadyYet
+	}
+	stamp, err := iconFileStamp(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := wt.runOnLoop(func() error { return wt.reloadIconFile(path) }); err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(iconWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			current, err := iconFileStamp(path)
+			if err != nil || current == stamp {
+				// The file may be missing while it's being replaced
+				continue
+			}
+			err = wt.runOnLoop(func() error { return wt.reloadIconFile(path) })
+			if err != nil {
+				// Probably written only partially, so try again on the next tick
+				logf("systray error: failed to reload watched icon: %s\n", err)
+				continue
+			}
+			stamp = current
+		}
+	}()
+
+	iconWatchersLock.Lock()
+	iconWatcherID++
+	id := iconWatcherID
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			iconWatchersLock.Lock()
+			delete(iconWatchers, id)
+			iconWatchersLock.Unlock()
+			// Not waiting for the goroutine, which may be waiting for the message loop
+			close(done)
+		})
+	}
+	iconWatchers[id] = stop
+	iconWatchersLock.Unlock()
+	return stop, nil
+}
+
+// Load the icon file again and show it in the tray.
+// Loaded icons are cached by path, which would keep showing the old content.
+func (t *winTray) reloadIconFile(path string) error {
+	h, err := t.loadIconUncached(path)
+	if err != nil {
+		return err
+	}
+	return t.setTrayIcon(h, true, nil)
+}
+
+// Stop all icon file watchers.
+func stopIconWatchers() {
+	iconWatchersLock.Lock()
+	stops := make([]func(), 0, len(iconWatchers))
+	for _, stop := range iconWatchers {
+		stops = append(stops, stop)
+	}
+	iconWatchersLock.Unlock()
+	for _, stop := range stops {
+		stop()
+	}
+}
+
+// Modification time and size of a file, to detect changes.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Return the modification time and size of the file at path.
+func iconFileStamp(path string) (fileStamp, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{fi.ModTime(), fi.Size()}, nil
+}
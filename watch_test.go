@@ -0,0 +1,54 @@
+//go:build windows
+
+package wintray
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var pGetIconInfo = u32.NewProc("GetIconInfo")
+
+// Return whether an icon still exists, i.e. hasn't been destroyed.
+func iconExists(h windows.Handle) bool {
+	var info iconInfo
+	res, _, _ := pGetIconInfo.Call(uintptr(h), uintptr(unsafe.Pointer(&info)))
+	if res == 0 {
+		return false
+	}
+	// The bitmaps are copies owned by the caller
+	pDeleteObject.Call(uintptr(info.Mask))
+	pDeleteObject.Call(uintptr(info.Color))
+	return true
+}
+
+func TestWatchIconFileReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "icon.ico")
+	if err := os.WriteFile(path, testIcon(16, 0xFFFF0000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stop, err := WatchIconFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	trayIcon := func() windows.Handle {
+		wt.muNID.Lock()
+		defer wt.muNID.Unlock()
+		return wt.trayIcon
+	}
+	first := trayIcon()
+
+	// The size differs too, so the change is seen even if the modification time doesn't
+	if err := os.WriteFile(path, testIcon(32, 0xFF0000FF), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return trayIcon() != first }, "the changed icon to be loaded")
+	if iconExists(first) {
+		t.Error("icon of the old file content wasn't destroyed")
+	}
+}
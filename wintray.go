@@ -4,18 +4,19 @@
 package wintray
 
 import (
-	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"hash/fnv"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
-	"syscall"
+	"time"
+	"unicode/utf16"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
@@ -26,8 +27,18 @@ var (
 	systrayReady func()
 	// Callback function to be called when the systray is exited
 	systrayExit func()
+	// Whether or not systrayExit has been called
+	systrayExitStarted bool
+	// Lock to protect systrayExit and systrayExitStarted
+	systrayExitLock sync.Mutex
 	// Ensures systrayExit is called only once
 	systrayExitOnce sync.Once
+	// Locks of the temp icon files by path, of type *sync.Mutex
+	iconFileLocks sync.Map
+	// Path of the icon shown when loading an icon fails, if any
+	fallbackIconPath atomic.Pointer[string]
+	// Directory of the temp icon files, or nil for the system temp directory
+	iconTempDir atomic.Pointer[string]
 	// Map of menu item ID's to their respective MenuItem objects
 	menuItems = make(map[uint32]*MenuItem)
 	// Lock to protect menuItems
@@ -36,110 +47,530 @@ var (
 	currentID atomic.Uint32
 	// Ensures Quit is called only once
 	quitOnce sync.Once
+	// Whether or not Quit has been called
+	quitting atomic.Bool
 	// Callbacks to be called when the tray is opened
-	trayOpenedCallbacks []func()
+	trayOpenedCallbacks []trayOpenedCallback
+	// Lock to protect trayOpenedCallbacks
+	trayOpenedCallbacksLock sync.RWMutex
+	// ID to assign to the next tray opened callback
+	currentCallbackID atomic.Uint32
+	// Callback deciding whether the session may end
+	queryEndSessionCallback func() bool
+	// Callback deciding whether a right click opens the menu
+	rightClickCallback func() (openMenu bool)
+	// Callback deciding whether a left click opens the menu
+	leftClickCallback func() (openMenu bool)
+	// Function computing the tooltip when it's shown
+	tooltipFunc func() string
+	// Callback called when the menu is closed
+	menuClosedCallback func()
+	// Callback called when the shell has accepted the icon
+	iconAddedCallback func()
+	// Lock to protect callbacks set by the application
+	callbacksLock sync.RWMutex
 	// Whether or not the icon should respond to left/right clicks
-	openOnLeftClick  = true
-	openOnRightClick = true
+	openOnLeftClick  atomic.Bool
+	openOnRightClick atomic.Bool
+	// Whether or not to force the tray window to the foreground when showing the menu
+	foregroundWorkaround atomic.Bool
+	// Whether or not the icon and the menu respond to clicks at all
+	interactive atomic.Bool
+	// Maximum height of the menus in pixels, or 0 for the screen height
+	menuMaxHeight atomic.Uint32
+	// Maximum length of menu item titles in UTF-16 units, or 0 for no limit
+	maxMenuItemLength atomic.Int64
+	// Brush painting the background of the menus, or 0 for the default background
+	menuBackground atomic.Uintptr
+	// Lock to serialize the changes of menuBackground, so that each brush is deleted once
+	menuBackgroundLock sync.Mutex
+	// Time after which an idle menu is closed, or 0 to keep it open
+	menuAutoDismiss atomic.Int64
+	// Whether or not the menu is shown again after a checkable item is clicked
+	keepOpenOnToggle atomic.Bool
+	// How new menu items are positioned among their siblings, an OrderingMode
+	menuOrdering atomic.Uint32
+	// ID of the tray icon, identifying it along with the window
+	iconID atomic.Uint32
+	// Whether or not showMenu gets the chosen item from TrackPopupMenu and
+	// dispatches it directly, rather than waiting for WM_COMMAND
+	menuReturnCmd atomic.Bool
 )
 
 var (
 	g32                     = windows.NewLazySystemDLL("Gdi32.dll")
 	pCreateCompatibleBitmap = g32.NewProc("CreateCompatibleBitmap")
 	pCreateCompatibleDC     = g32.NewProc("CreateCompatibleDC")
+	pBitBlt                 = g32.NewProc("BitBlt")
+	pCreateBitmap           = g32.NewProc("CreateBitmap")
 	pCreateDIBSection       = g32.NewProc("CreateDIBSection")
+	pCreateSolidBrush       = g32.NewProc("CreateSolidBrush")
 	pDeleteDC               = g32.NewProc("DeleteDC")
+	pDeleteObject           = g32.NewProc("DeleteObject")
+	pGdiFlush               = g32.NewProc("GdiFlush")
 	pSelectObject           = g32.NewProc("SelectObject")
 
 	k32              = windows.NewLazySystemDLL("Kernel32.dll")
 	pGetModuleHandle = k32.NewProc("GetModuleHandleW")
-
-	s32              = windows.NewLazySystemDLL("Shell32.dll")
-	pShellNotifyIcon = s32.NewProc("Shell_NotifyIconW")
-
-	u32                    = windows.NewLazySystemDLL("User32.dll")
-	pCreateMenu            = u32.NewProc("CreateMenu")
-	pCreatePopupMenu       = u32.NewProc("CreatePopupMenu")
-	pCreateWindowEx        = u32.NewProc("CreateWindowExW")
-	pDefWindowProc         = u32.NewProc("DefWindowProcW")
-	pDeleteMenu            = u32.NewProc("DeleteMenu")
-	pDestroyMenu           = u32.NewProc("DestroyMenu")
-	pRemoveMenu            = u32.NewProc("RemoveMenu")
-	pDestroyWindow         = u32.NewProc("DestroyWindow")
-	pDispatchMessage       = u32.NewProc("DispatchMessageW")
-	pDrawIconEx            = u32.NewProc("DrawIconEx")
-	pGetCursorPos          = u32.NewProc("GetCursorPos")
-	pGetDC                 = u32.NewProc("GetDC")
-	pGetMessage            = u32.NewProc("GetMessageW")
-	pGetSystemMetrics      = u32.NewProc("GetSystemMetrics")
-	pInsertMenuItem        = u32.NewProc("InsertMenuItemW")
-	pLoadCursor            = u32.NewProc("LoadCursorW")
-	pLoadIcon              = u32.NewProc("LoadIconW")
-	pLoadImage             = u32.NewProc("LoadImageW")
-	pPostMessage           = u32.NewProc("PostMessageW")
-	pPostQuitMessage       = u32.NewProc("PostQuitMessage")
-	pRegisterClass         = u32.NewProc("RegisterClassExW")
-	pRegisterWindowMessage = u32.NewProc("RegisterWindowMessageW")
-	pReleaseDC             = u32.NewProc("ReleaseDC")
-	pSetForegroundWindow   = u32.NewProc("SetForegroundWindow")
-	pSetMenuInfo           = u32.NewProc("SetMenuInfo")
-	pSetMenuItemInfo       = u32.NewProc("SetMenuItemInfoW")
-	pShowWindow            = u32.NewProc("ShowWindow")
-	pTrackPopupMenu        = u32.NewProc("TrackPopupMenu")
-	pTranslateMessage      = u32.NewProc("TranslateMessage")
-	pUnregisterClass       = u32.NewProc("UnregisterClassW")
-	pUpdateWindow          = u32.NewProc("UpdateWindow")
+	pGlobalAlloc     = k32.NewProc("GlobalAlloc")
+	pGlobalFree      = k32.NewProc("GlobalFree")
+	pGlobalLock      = k32.NewProc("GlobalLock")
+	pGlobalUnlock    = k32.NewProc("GlobalUnlock")
+	pRtlMoveMemory   = k32.NewProc("RtlMoveMemory")
+
+	s32                     = windows.NewLazySystemDLL("Shell32.dll")
+	pShellNotifyIcon        = s32.NewProc("Shell_NotifyIconW")
+	pExtractIconEx          = s32.NewProc("ExtractIconExW")
+	pSHAppBarMessage        = s32.NewProc("SHAppBarMessage")
+	pShellNotifyIconGetRect = s32.NewProc("Shell_NotifyIconGetRect")
+
+	u32                            = windows.NewLazySystemDLL("User32.dll")
+	pAddClipboardFormatListener    = u32.NewProc("AddClipboardFormatListener")
+	pAttachThreadInput             = u32.NewProc("AttachThreadInput")
+	pCallNextHookEx                = u32.NewProc("CallNextHookEx")
+	pCloseClipboard                = u32.NewProc("CloseClipboard")
+	pCreateIcon                    = u32.NewProc("CreateIcon")
+	pCreateIconFromResourceEx      = u32.NewProc("CreateIconFromResourceEx")
+	pCreateIconIndirect            = u32.NewProc("CreateIconIndirect")
+	pCreateMenu                    = u32.NewProc("CreateMenu")
+	pCreatePopupMenu               = u32.NewProc("CreatePopupMenu")
+	pCreateWindowEx                = u32.NewProc("CreateWindowExW")
+	pDefWindowProc                 = u32.NewProc("DefWindowProcW")
+	pDeleteMenu                    = u32.NewProc("DeleteMenu")
+	pDestroyIcon                   = u32.NewProc("DestroyIcon")
+	pDestroyMenu                   = u32.NewProc("DestroyMenu")
+	pRemoveMenu                    = u32.NewProc("RemoveMenu")
+	pDestroyWindow                 = u32.NewProc("DestroyWindow")
+	pDispatchMessage               = u32.NewProc("DispatchMessageW")
+	pDrawIconEx                    = u32.NewProc("DrawIconEx")
+	pEmptyClipboard                = u32.NewProc("EmptyClipboard")
+	pFindWindow                    = u32.NewProc("FindWindowW")
+	pGetCursorPos                  = u32.NewProc("GetCursorPos")
+	pGetDC                         = u32.NewProc("GetDC")
+	pGetDpiForWindow               = u32.NewProc("GetDpiForWindow")
+	pGetForegroundWindow           = u32.NewProc("GetForegroundWindow")
+	pGetKeyNameText                = u32.NewProc("GetKeyNameTextW")
+	pGetKeyState                   = u32.NewProc("GetKeyState")
+	pGetMessage                    = u32.NewProc("GetMessageW")
+	pGetMonitorInfo                = u32.NewProc("GetMonitorInfoW")
+	pGetSystemMetrics              = u32.NewProc("GetSystemMetrics")
+	pGetSystemMetricsForDpi        = u32.NewProc("GetSystemMetricsForDpi")
+	pGetWindowRect                 = u32.NewProc("GetWindowRect")
+	pGetWindowThreadProcId         = u32.NewProc("GetWindowThreadProcessId")
+	pInsertMenuItem                = u32.NewProc("InsertMenuItemW")
+	pLoadCursor                    = u32.NewProc("LoadCursorW")
+	pLoadIcon                      = u32.NewProc("LoadIconW")
+	pLoadImage                     = u32.NewProc("LoadImageW")
+	pLookupIconIdFromDirectoryEx   = u32.NewProc("LookupIconIdFromDirectoryEx")
+	pMapVirtualKey                 = u32.NewProc("MapVirtualKeyW")
+	pMonitorFromRect               = u32.NewProc("MonitorFromRect")
+	pOpenClipboard                 = u32.NewProc("OpenClipboard")
+	pPeekMessage                   = u32.NewProc("PeekMessageW")
+	pPostMessage                   = u32.NewProc("PostMessageW")
+	pPostQuitMessage               = u32.NewProc("PostQuitMessage")
+	pRegisterClass                 = u32.NewProc("RegisterClassExW")
+	pRegisterHotKey                = u32.NewProc("RegisterHotKey")
+	pRegisterWindowMessage         = u32.NewProc("RegisterWindowMessageW")
+	pReleaseDC                     = u32.NewProc("ReleaseDC")
+	pRemoveClipboardFormatListener = u32.NewProc("RemoveClipboardFormatListener")
+	pSetClipboardData              = u32.NewProc("SetClipboardData")
+	pSetForegroundWindow           = u32.NewProc("SetForegroundWindow")
+	pSetMenuInfo                   = u32.NewProc("SetMenuInfo")
+	pSetMenuItemInfo               = u32.NewProc("SetMenuItemInfoW")
+	pSetWindowsHookEx              = u32.NewProc("SetWindowsHookExW")
+	pShowWindow                    = u32.NewProc("ShowWindow")
+	pShutdownBlockReasonCreate     = u32.NewProc("ShutdownBlockReasonCreate")
+	pShutdownBlockReasonDestroy    = u32.NewProc("ShutdownBlockReasonDestroy")
+	pTrackPopupMenu                = u32.NewProc("TrackPopupMenu")
+	pTranslateMessage              = u32.NewProc("TranslateMessage")
+	pUnhookWindowsHookEx           = u32.NewProc("UnhookWindowsHookEx")
+	pUnregisterClass               = u32.NewProc("UnregisterClassW")
+	pUnregisterHotKey              = u32.NewProc("UnregisterHotKey")
+	pUpdateWindow                  = u32.NewProc("UpdateWindow")
+
+	wts                               = windows.NewLazySystemDLL("Wtsapi32.dll")
+	pWTSRegisterSessionNotification   = wts.NewProc("WTSRegisterSessionNotification")
+	pWTSUnRegisterSessionNotification = wts.NewProc("WTSUnRegisterSessionNotification")
 
 	// ErrTrayNotReadyYet is returned by functions when they are called before the tray has been initialized.
 	ErrTrayNotReadyYet = errors.New("tray not ready yet")
+	// ErrTrayQuitting is returned by functions when they are called after Quit.
+	ErrTrayQuitting = errors.New("tray is shutting down")
 )
 
+// Whether or not init's lock of the main goroutine to the main OS thread has been undone
+var threadLockDisabled atomic.Bool
+
 // Lock the OS thread to ensure that the message loop runs on the main thread.
 func init() {
 	runtime.LockOSThread()
+	openOnLeftClick.Store(true)
+	openOnRightClick.Store(true)
+	foregroundWorkaround.Store(true)
+	interactive.Store(true)
+	iconID.Store(100)
+}
+
+// CallbackID identifies a registered callback so that it can be removed later.
+type CallbackID uint32
+
+// A callback registered with OnTrayOpened.
+type trayOpenedCallback struct {
+	id CallbackID
+	f  func()
 }
 
 // Add a callback to be called when the tray is opened.
-func OnTrayOpened(f func()) {
-	trayOpenedCallbacks = append(trayOpenedCallbacks, f)
+// The returned ID can be passed to RemoveTrayOpenedCallback.
+func OnTrayOpened(f func()) CallbackID {
+	id := CallbackID(currentCallbackID.Add(1))
+	trayOpenedCallbacksLock.Lock()
+	trayOpenedCallbacks = append(trayOpenedCallbacks, trayOpenedCallback{id, f})
+	trayOpenedCallbacksLock.Unlock()
+	return id
+}
+
+// Remove a callback previously added with OnTrayOpened.
+func RemoveTrayOpenedCallback(id CallbackID) {
+	trayOpenedCallbacksLock.Lock()
+	defer trayOpenedCallbacksLock.Unlock()
+	for i, cb := range trayOpenedCallbacks {
+		if cb.id == id {
+			trayOpenedCallbacks = append(trayOpenedCallbacks[:i:i], trayOpenedCallbacks[i+1:]...)
+			return
+		}
+	}
+}
+
+// Remove all callbacks added with OnTrayOpened.
+func ClearTrayOpenedCallbacks() {
+	trayOpenedCallbacksLock.Lock()
+	trayOpenedCallbacks = nil
+	trayOpenedCallbacksLock.Unlock()
+}
+
+// Show the tray icon after it was hidden with HideTrayIcon or RegisterHidden.
+func ShowTrayIcon() error {
+	if !wt.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	wt.muNID.Lock()
+	defer wt.muNID.Unlock()
+	if err := wt.setIconHidden(false); err != nil {
+		return fmt.Errorf("failed to show tray icon: %w", err)
+	}
+	if !wt.iconAdded {
+		if err := wt.nid.add(); err != nil {
+			return fmt.Errorf("failed to show tray icon: %w", err)
+		}
+		wt.iconAdded = true
+		runIconAdded()
+	}
+	return nil
+}
+
+// Hide the tray icon. The menu and other settings are kept.
+// The icon is hidden rather than removed, so it keeps its position
+// and the user's notification area preferences.
+func HideTrayIcon() error {
+	if !wt.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	wt.muNID.Lock()
+	defer wt.muNID.Unlock()
+	if err := wt.setIconHidden(true); err != nil {
+		return fmt.Errorf("failed to hide tray icon: %w", err)
+	}
+	return nil
+}
+
+// Replace the onExit callback passed to Register.
+// Does nothing once the callback has started running.
+func SetOnExit(f func()) {
+	if f == nil {
+		f = func() {}
+	}
+	systrayExitLock.Lock()
+	defer systrayExitLock.Unlock()
+	if !systrayExitStarted {
+		systrayExit = f
+	}
+}
+
+// Call the onExit callback.
+func runOnExit() {
+	systrayExitLock.Lock()
+	systrayExitStarted = true
+	f := systrayExit
+	systrayExitLock.Unlock()
+	if f != nil {
+		f()
+	}
+}
+
+// Set a callback to be called when the user logs off or the system shuts down.
+// Return false to ask Windows to cancel the logoff or shutdown, or true to allow it.
+// The callback runs on the message loop thread and should return promptly.
+// If no callback is set, the session is allowed to end.
+func OnQueryEndSession(f func() bool) {
+	callbacksLock.Lock()
+	queryEndSessionCallback = f
+	callbacksLock.Unlock()
+}
+
+// Set a callback to be called when the icon is right-clicked.
+// Return true to open the menu, or false to suppress it.
+// When set, it takes precedence over SetOpenOnRightClick.
+// The callback runs on the message loop thread and should return promptly.
+func OnRightClick(f func() (openMenu bool)) {
+	callbacksLock.Lock()
+	rightClickCallback = f
+	callbacksLock.Unlock()
+}
+
+// Set a callback to be called when the icon is left-clicked, deciding on each click
+// whether to open the menu, e.g. to restore the main window instead when there is one.
+// When set, it takes precedence over SetOpenOnLeftClick. Pass nil to remove it.
+// The callback runs on the message loop thread and should return promptly.
+func SetLeftClickHandler(f func() (openMenu bool)) {
+	callbacksLock.Lock()
+	leftClickCallback = f
+	callbacksLock.Unlock()
 }
 
 // Set whether or not the icon should respond to left clicks.
 // The default is true.
 func SetOpenOnLeftClick(open bool) {
-	openOnLeftClick = open
+	openOnLeftClick.Store(open)
 }
 
 // Set whether or not the icon should respond to right clicks.
 // The default is true.
 func SetOpenOnRightClick(open bool) {
-	openOnRightClick = open
+	openOnRightClick.Store(open)
+}
+
+// Set whether or not the tray responds to clicks, e.g. to ignore them during a critical operation.
+// While false, clicks on the icon don't open the menu and clicks on menu items are ignored.
+// The default is true.
+func SetInteractive(enabled bool) {
+	interactive.Store(enabled)
+}
+
+// Set whether or not to work around Windows refusing to bring the tray window
+// to the foreground when the menu is shown from a background process.
+// Without it, the menu may fail to appear or to close when clicking elsewhere.
+// The default is true.
+func SetForegroundWorkaround(enabled bool) {
+	foregroundWorkaround.Store(enabled)
+}
+
+// Set the maximum height of the menu and its submenus in pixels.
+// Menus with more items than fit are given scroll arrows.
+// The default of 0 limits menus to the height of the screen.
+func SetMenuMaxHeight(height uint32) error {
+	menuMaxHeight.Store(height)
+	if !wt.isReady() {
+		return nil
+	}
+	wt.muMenus.RLock()
+	defer wt.muMenus.RUnlock()
+	if err := wt.setMenuInfo(wt.menus[0]); err != nil {
+		return fmt.Errorf("failed to set menu height: %w", err)
+	}
+	return nil
+}
+
+// Set the background color of the menu and its submenus.
+func SetMenuBackgroundColor(r, g, b uint8) error {
+	menuBackgroundLock.Lock()
+	defer menuBackgroundLock.Unlock()
+	colorRef := uintptr(r) | uintptr(g)<<8 | uintptr(b)<<16
+	brush, _, err := pCreateSolidBrush.Call(colorRef)
+	if brush == 0 {
+		return fmt.Errorf("failed to create brush: %w", err)
+	}
+	oldBrush := menuBackground.Swap(brush)
+	if wt.isReady() {
+		wt.muMenus.RLock()
+		err = wt.setMenuInfo(wt.menus[0])
+		wt.muMenus.RUnlock()
+		if err != nil {
+			// The menus still use the old brush
+			menuBackground.Store(oldBrush)
+			pDeleteObject.Call(brush)
+			return fmt.Errorf("failed to set menu background: %w", err)
+		}
+	}
+	if oldBrush != 0 {
+		pDeleteObject.Call(oldBrush)
+	}
+	return nil
+}
+
+// Delete the brush of the menu background, once the menus won't be shown anymore.
+func deleteMenuBackground() {
+	menuBackgroundLock.Lock()
+	defer menuBackgroundLock.Unlock()
+	if brush := menuBackground.Swap(0); brush != 0 {
+		pDeleteObject.Call(brush)
+	}
+}
+
+// Shorten menu item titles longer than n UTF-16 characters, ending them with an ellipsis.
+// Title still returns the full title. It applies to items updated afterwards.
+// The default of 0 doesn't limit the length.
+func SetMaxMenuItemLength(n int) {
+	if n < 0 {
+		n = 0
+	}
+	maxMenuItemLength.Store(int64(n))
+}
+
+// Close the menu if the user doesn't interact with it for the given duration.
+// Hovering over or selecting items restarts the timeout.
+// The default of 0 keeps the menu open until the user dismisses it.
+func SetMenuAutoDismiss(d time.Duration) {
+	menuAutoDismiss.Store(int64(d))
+}
+
+// Close the menu if it's open, as if the user dismissed it,
+// e.g. when a background event made it irrelevant. Can be called from any goroutine.
+func CloseMenu() {
+	if !wt.menuOpen.Load() {
+		return
+	}
+	// Ends the modal menu loop of TrackPopupMenu
+	const WM_CANCELMODE = 0x001F
+	pPostMessage.Call(uintptr(wt.window), WM_CANCELMODE, 0, 0)
+}
+
+// Set a callback to be called when the menu is closed, whether an item was chosen,
+// the user dismissed it, or it was closed by CloseMenu or SetMenuAutoDismiss.
+// The callback runs on a new goroutine.
+func OnMenuClosed(f func()) {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	menuClosedCallback = f
+}
+
+// Set whether the menu is shown again at the same position after a checkable item is clicked,
+// so that several toggles can be flipped in a row. Standard menus always close when an item
+// is chosen, so the menu briefly flickers as it is reopened. The callback of the item runs
+// concurrently, so the reopened menu may still show the previous check state if it's slow.
+// Items are checkable once they have been checked or unchecked, or made radio items.
+// The default is false.
+func SetKeepOpenOnToggle(keep bool) {
+	keepOpenOnToggle.Store(keep)
+}
+
+// Set whether the chosen menu item is dispatched as soon as the menu closes,
+// rather than when the WM_COMMAND message posted by the menu is handled.
+// The default is false.
+func SetSyncMenuDispatch(enabled bool) {
+	menuReturnCmd.Store(enabled)
+}
+
+// Undo the lock of the main goroutine to the main OS thread done when the package is initialized,
+// for toolkits that manage the thread locking themselves.
+// It must be called from the main goroutine, e.g. at the start of main.
+// Register and the message loop must then be run on a goroutine locked to its OS thread.
+// Since thread locks nest, a lock taken by the toolkit itself is kept.
+func DisableAutoThreadLock() {
+	if threadLockDisabled.CompareAndSwap(false, true) {
+		runtime.UnlockOSThread()
+	}
+}
+
+// Set the ID identifying the tray icon along with the hidden window, e.g. for external tooling.
+// It must be called before Register. The default is 100.
+// Only the low 16 bits are reported in tray messages, so IDs should be below 65536.
+// The icon is always identified by its ID, since GUIDs (NIF_GUID) aren't supported.
+func SetIconID(id uint32) error {
+	if wt.isReady() {
+		return errors.New("the icon ID must be set before Register")
+	}
+	iconID.Store(id)
+	return nil
+}
+
+// OrderingMode decides where new menu items are placed among their siblings.
+type OrderingMode uint32
+
+const (
+	// Place menu items in the order they were created, even when shown again after being hidden
+	OrderByID OrderingMode = iota
+	// Place menu items after their siblings when they're added or shown again
+	OrderByInsertion
+)
+
+// Set where new menu items are placed. The default is OrderByID.
+// Call it before adding menu items, since items already in the menu keep their position.
+func SetMenuOrdering(mode OrderingMode) {
+	menuOrdering.Store(uint32(mode))
 }
 
 // MenuItem is used to keep track each menu item of systray.
 // Don't create it directly, use systray.AddMenuItem()
 type MenuItem struct {
+	// Lock to protect the mutable fields below
+	mu sync.RWMutex
+
 	// Callback function to be called when the menu item is clicked
 	onClick func()
+	// Callback function receiving the modifier keys, used instead of onClick if set
+	onClickMods func(mods Modifiers)
 
 	// Unique identifier for the menu item; not to be modified
 	id uint32
+	// Whether the menu item is a separator bar; not to be modified
+	separator bool
+	// ID of the MenuSpec the menu item was built from, if any; not to be modified
+	specID string
 	// The text shown on the menu item
 	title string
+	// Whether or not an ampersand in the title marks a mnemonic rather than being shown literally
+	mnemonic bool
 	// Whether or not the menu item is disabled
 	disabled bool
+	// Whether or not the menu item was hidden with Hide, keeping it out of its menu when updated
+	hidden bool
+	// Function deciding whether the menu item is enabled, called when the menu opens
+	enabledFunc func() bool
 	// Whether or not the menu item is checked
 	checked bool
-	// Parent menu item, for submenus
+	// Whether or not the menu item is grayed out but still clickable
+	grayed bool
+	// Whether or not the check mark is shown as a radio dot
+	radio bool
+	// Whether or not the menu item has been checked or unchecked, i.e. is a toggle
+	checkable bool
+	// Virtual-key code of the registered hotkey, or 0 if none
+	hotkeyVK uint32
+	// Text of the hotkey shown next to the title
+	hotkeyText string
+	// Data attached by the application
+	data any
+	// Parent menu item, for submenus; changed only by Reparent
 	parent *MenuItem
+	// Bitmap of the icon set on the menu item, if any
+	icon windows.Handle
+	// Function drawing the bitmap of the icon again, e.g. when the icon size changes
+	iconSource func() (windows.Handle, error)
+	// Whether or not the menu item shows a notification badge
+	badge bool
+	// Bitmap of the icon with the badge drawn on it, if any
+	badgeIcon windows.Handle
 }
 
 // Return a string representation of the MenuItem for debugging
 func (item *MenuItem) String() string {
-	if item.parent == nil {
-		return fmt.Sprintf("MenuItem[%d, %q]", item.id, item.title)
+	title := item.Title()
+	parentId := item.parentId()
+	if parentId == 0 {
+		return fmt.Sprintf("MenuItem[%d, %q]", item.id, title)
 	}
-	return fmt.Sprintf("MenuItem[%d, parent %d, %q]", item.id, item.parent.id, item.title)
+	return fmt.Sprintf("MenuItem[%d, parent %d, %q]", item.id, parentId, title)
 }
 
 // Return a populated MenuItem object.
@@ -154,6 +585,56 @@ func newMenuItem(title string, parent *MenuItem) *MenuItem {
 	}
 }
 
+// Add the icon to the notification area again with its current icon and tooltip,
+// as is done automatically when Explorer restarts.
+// Use it if the icon went missing without the taskbar announcing its restart.
+func RecreateIcon() error {
+	return wt.runOnLoop(wt.recreateIcon)
+}
+
+// Add the icon to the notification area again if it was shown.
+// Must be called on the message loop thread.
+func (t *winTray) recreateIcon() error {
+	t.muNID.Lock()
+	defer t.muNID.Unlock()
+	if !t.iconAdded {
+		return nil
+	}
+	// The icon may still exist, in which case it couldn't be added
+	t.nid.delete()
+	if err := t.nid.add(); err != nil {
+		return err
+	}
+	runIconAdded()
+	return nil
+}
+
+// Set a callback to be called each time the shell has accepted the tray icon:
+// when it's first shown, and when it's added again after Explorer restarted.
+// Set it before Register to be notified the first time. The callback runs on a new goroutine.
+func OnIconAdded(f func()) {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	iconAddedCallback = f
+}
+
+// Call the callback set with OnIconAdded, if any.
+func runIconAdded() {
+	callbacksLock.RLock()
+	f := iconAddedCallback
+	callbacksLock.RUnlock()
+	if f != nil {
+		go f()
+	}
+}
+
+// Return whether the notification area is available, i.e. whether the taskbar is running.
+// It isn't on Server Core installations or in services running in session 0, for example.
+// Call it before Register to decide whether to fall back to a regular window.
+func IsTrayAvailable() bool {
+	return taskbarWindow() != 0
+}
+
 // Initialize the GUI and start the event loop, then invoke the onReady
 // callback. Blocks until systray.Quit() is called.
 func Run(onReady, onExit func()) error {
@@ -175,12 +656,72 @@ func RunWithExternalLoop(onReady, onExit func()) (start, end func(), err error)
 	return func() { go nativeLoop() }, Quit, nil
 }
 
+// MessagePump returns a function that runs the systray message loop until Quit is called.
+// For toolkits that own the main thread, the returned function must be run
+// on the same OS thread that called Register, since Windows only delivers
+// messages for a window to the thread that created it.
+func MessagePump() func() {
+	return nativeLoop
+}
+
+// PumpOnce dispatches all pending systray messages without blocking.
+// It returns false once the message loop has been quit.
+// Like MessagePump, it must be called on the OS thread that called Register.
+func PumpOnce() (more bool) {
+	const PM_REMOVE = 0x0001
+	const WM_QUIT = 0x0012
+	m := &msg{}
+	for {
+		ret, _, _ := pPeekMessage.Call(uintptr(unsafe.Pointer(m)), 0, 0, 0, PM_REMOVE)
+		if ret == 0 {
+			return true
+		}
+		if m.Message == WM_QUIT {
+			setDone()
+			return false
+		}
+		pTranslateMessage.Call(uintptr(unsafe.Pointer(m)))
+		pDispatchMessage.Call(uintptr(unsafe.Pointer(m)))
+	}
+}
+
 // Initializes the GUI and register the callbacks. Relies on the
 // caller to run the event loop somewhere else. Useful if the program
 // needs to show other UI elements.
 func Register(onReady func(), onExit func()) error {
+	return RegisterWithOptions(onReady, onExit, Options{})
+}
+
+// Options are applied to the tray icon before it is first shown.
+type Options struct {
+	// Content of the .ico image to show in the tray
+	Icon []byte
+	// Tooltip to display on mouse hover of the tray icon
+	Tooltip string
+	// Don't show the tray icon until ShowTrayIcon is called
+	Hidden bool
+}
+
+// Like Register, but doesn't show the tray icon until ShowTrayIcon is called.
+// Useful for apps that decide at runtime whether they need a tray icon.
+func RegisterHidden(onReady func(), onExit func()) error {
+	return RegisterWithOptions(onReady, onExit, Options{Hidden: true})
+}
+
+// Like Register, but applies the options before the tray icon is first shown,
+// so that the icon and tooltip are correct from the start.
+func RegisterWithOptions(onReady func(), onExit func(), opts Options) error {
+	return register(onReady, onExit, Config{Options: opts})
+}
+
+// Initialize the GUI with the icon, tooltip and window settings of cfg.
+func register(onReady func(), onExit func(), cfg Config) error {
 	if onReady == nil {
 		systrayReady = func() {}
+	} else if cfg.SyncOnReady {
+		// Run onReady before Register returns, so that it can set up the menu
+		// without racing with the caller
+		systrayReady = onReady
 	} else {
 		// Run onReady on separate goroutine to avoid blocking event loop
 		readyCh := make(chan interface{})
@@ -197,44 +738,82 @@ func Register(onReady func(), onExit func()) error {
 	if onExit == nil {
 		onExit = func() {}
 	}
+	systrayExitLock.Lock()
 	systrayExit = onExit
-	if err := wt.initInstance(); err != nil {
+	systrayExitLock.Unlock()
+	if err := wt.initInstance(cfg); err != nil {
 		return fmt.Errorf("unable to initialize systray: %w", err)
 	}
 
-	if err := wt.createMenu(); err != nil {
+	wt.muMenus.Lock()
+	err := wt.createMenu()
+	wt.muMenus.Unlock()
+	if err != nil {
 		return fmt.Errorf("unable to create menu: %w", err)
 	}
 
-	wt.initialized.Store(true)
+	setReady()
 	systrayReady()
 	return nil
 }
 
 // Remove all menu items.
+// The icons of the removed items are freed, so they must be set again if the items are added back.
 func ResetMenu() {
-	menuItemsLock.Lock()
-	id := currentID.Load()
-	menuItemsLock.Unlock()
-	for i, item := range menuItems {
-		if i < id {
+	menuItemsLock.RLock()
+	items := make([]*MenuItem, 0, len(menuItems))
+	for _, item := range menuItems {
+		items = append(items, item)
+	}
+	menuItemsLock.RUnlock()
+	for _, item := range items {
+		menuItemsLock.RLock()
+		_, exists := menuItems[item.id]
+		menuItemsLock.RUnlock()
+		// Children are already gone along with their parent
+		if exists {
 			item.Remove()
 		}
 	}
-	_, _, err := pDestroyMenu.Call(uintptr(wt.menus[0]))
-	if err != nil {
-		log.Printf("systray error: failed to destroy menu: %s\n", err)
+	for _, item := range items {
+		item.freeIcons()
+	}
+	wt.muMenuItemIcons.Lock()
+	wt.menuItemIcons = make(map[uint32]windows.Handle)
+	wt.muMenuItemIcons.Unlock()
+	if !wt.isReady() {
+		// There's no menu to recreate yet
+		return
+	}
+	// Keep items from being added and the menu from being read
+	// until the new menu is in place
+	wt.muMenuUpdate.Lock()
+	defer wt.muMenuUpdate.Unlock()
+	wt.muMenus.Lock()
+	defer wt.muMenus.Unlock()
+	wt.muVisibleItems.Lock()
+	defer wt.muVisibleItems.Unlock()
+	wt.muMenuOf.Lock()
+	defer wt.muMenuOf.Unlock()
+	if menu := wt.menus[0]; menu != 0 {
+		if err := wt.api.DestroyMenu(menu); err != nil {
+			logf("systray error: failed to destroy menu: %s\n", err)
+		}
 	}
 	wt.visibleItems = make(map[uint32][]uint32)
 	wt.menus = make(map[uint32]windows.Handle)
 	wt.menuOf = make(map[uint32]windows.Handle)
-	wt.menuItemIcons = make(map[uint32]windows.Handle)
-	err = wt.createMenu()
+	err := wt.createMenu()
 	if err != nil {
-		log.Printf("systray error: failed to create menu: %s\n", err)
+		logf("systray error: failed to create menu: %s\n", err)
 	}
 }
 
+// Return whether Quit has been called, so that the tray is shutting down or gone.
+func IsQuitting() bool {
+	return quitting.Load()
+}
+
 // Quit the systray message loop.
 func Quit() {
 	quitOnce.Do(quit)
@@ -251,17 +830,40 @@ func AddMenuItem(title string) *MenuItem {
 // Set the function to be called when the menu item is clicked.
 // The function is called from a new goroutine.
 func (item *MenuItem) SetCallback(onClick func()) {
+	item.mu.Lock()
 	item.onClick = onClick
+	item.mu.Unlock()
+}
+
+// Set a callback to be called when the menu item is clicked, receiving the
+// modifier keys held down, e.g. to perform an alternate action on Shift+click.
+// It's called from a new goroutine and takes precedence over SetCallback.
+func (item *MenuItem) SetCallbackMods(onClick func(mods Modifiers)) {
+	item.mu.Lock()
+	item.onClickMods = onClick
+	item.mu.Unlock()
+}
+
+// Return the function to be called when the menu item is clicked.
+func (item *MenuItem) callback(mods Modifiers) func() {
+	item.mu.RLock()
+	defer item.mu.RUnlock()
+	if onClickMods := item.onClickMods; onClickMods != nil {
+		return func() { onClickMods(mods) }
+	}
+	return item.onClick
 }
 
 // Add a separator bar to the menu.
-func AddSeparator() {
-	addSeparator(currentID.Add(1), 0)
+// The returned MenuItem can be used to hide, show or remove the separator.
+func AddSeparator() *MenuItem {
+	return addSeparator(nil)
 }
 
 // Add a separator bar to the submenu.
-func (item *MenuItem) AddSeparator() {
-	addSeparator(currentID.Add(1), item.id)
+// The returned MenuItem can be used to hide, show or remove the separator.
+func (item *MenuItem) AddSeparator() *MenuItem {
+	return addSeparator(item)
 }
 
 // Add a nested sub-menu item with the designated title.
@@ -272,34 +874,122 @@ func (item *MenuItem) AddSubMenuItem(title string) *MenuItem {
 	return child
 }
 
+// Like AddSubMenuItem, but returns an error if the menu item couldn't be added,
+// e.g. because the submenu couldn't be created or the tray isn't ready yet.
+func (item *MenuItem) AddSubMenuItemErr(title string) (*MenuItem, error) {
+	child := newMenuItem(title, item)
+	if err := child.add(); err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
 // Set the text to display on a menu item.
+// Ampersands are shown literally; use SetTitleWithMnemonic to underline an access key.
 func (item *MenuItem) SetTitle(title string) {
+	item.mu.Lock()
+	item.title = title
+	item.mnemonic = false
+	item.mu.Unlock()
+	item.update()
+}
+
+// Set the text to display on a menu item, where the character after an ampersand
+// is underlined and selects the item when typed while the menu is open, e.g. "&Open".
+// Use "&&" to show a literal ampersand.
+// https://learn.microsoft.com/en-us/windows/win32/menurc/about-menus#menu-access-keys
+func (item *MenuItem) SetTitleWithMnemonic(title string) {
+	item.mu.Lock()
 	item.title = title
+	item.mnemonic = true
+	item.mu.Unlock()
 	item.update()
 }
 
+// Return the text displayed on a menu item.
+func (item *MenuItem) Title() string {
+	item.mu.RLock()
+	defer item.mu.RUnlock()
+	return item.title
+}
+
 // Return whether the menu item is disabled.
 func (item *MenuItem) Disabled() bool {
+	item.mu.RLock()
+	defer item.mu.RUnlock()
 	return item.disabled
 }
 
 // Enable a menu item regardless if it's previously enabled or not.
 func (item *MenuItem) Enable() {
+	item.mu.Lock()
 	item.disabled = false
+	item.mu.Unlock()
 	item.update()
 }
 
 // Disable a menu item regardless if it's previously disabled or not.
 func (item *MenuItem) Disable() {
+	item.mu.Lock()
 	item.disabled = true
+	item.mu.Unlock()
 	item.update()
 }
 
-// Hide a menu item.
+// Set a function deciding whether the menu item is enabled, e.g. depending on the state
+// of the application. It's called on the message loop thread right before the menu is shown
+// and should return promptly. It overrides Enable and Disable. Pass nil to remove it.
+func (item *MenuItem) SetEnabledFunc(f func() bool) {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	item.enabledFunc = f
+}
+
+// Enable or disable the menu items with an enabled function before the menu is shown.
+// Hidden items are updated without being shown.
+func (t *winTray) refreshEnabledItems() {
+	menuItemsLock.RLock()
+	items := make([]*MenuItem, 0, len(menuItems))
+	for _, item := range menuItems {
+		items = append(items, item)
+	}
+	menuItemsLock.RUnlock()
+	for _, item := range items {
+		item.mu.RLock()
+		f := item.enabledFunc
+		item.mu.RUnlock()
+		if f == nil {
+			continue
+		}
+		enabled := f()
+		item.mu.Lock()
+		changed := item.disabled == enabled
+		item.disabled = !enabled
+		item.mu.Unlock()
+		if changed && t.getVisibleItemIndex(item.parentId(), item.id) != -1 {
+			if err := item.apply(); err != nil {
+				logf("systray error: failed to update menu item: %s\n", err)
+			}
+		}
+	}
+}
+
+// Call the menu item's callback as if it was clicked, unless the item is disabled.
+// Like a real click, the callback is called from a new goroutine.
+func (item *MenuItem) Click() {
+	if onClick := item.callback(0); onClick != nil && !item.Disabled() {
+		go onClick()
+	}
+}
+
+// Hide a menu item. It stays hidden when its properties are changed, until Show is called.
 func (item *MenuItem) Hide() {
+	item.mu.Lock()
+	item.hidden = true
+	item.mu.Unlock()
 	err := wt.hideMenuItem(uint32(item.id), item.parentId())
 	if err != nil {
-		log.Printf("systray error: failed to hide menu item: %s\n", err)
+		logf("systray error: failed to hide menu item: %s\n", err)
 	}
 }
 
@@ -309,7 +999,7 @@ func (item *MenuItem) Remove() {
 	menuItemsLock.RLock()
 	childList := make([]*MenuItem, 0, len(menuItems))
 	for _, child := range menuItems {
-		if child.parent == item {
+		if child.parentItem() == item {
 			childList = append(childList, child)
 		}
 	}
@@ -317,35 +1007,144 @@ func (item *MenuItem) Remove() {
 	for _, child := range childList {
 		child.Remove()
 	}
+	if err := item.removeHotkey(); err != nil {
+		logf("systray error: failed to unregister hotkey: %s\n", err)
+	}
 	err := wt.removeMenuItem(uint32(item.id), item.parentId())
 	if err != nil {
-		log.Printf("systray error: unable to removeMenuItem: %s\n", err)
+		logf("systray error: unable to removeMenuItem: %s\n", err)
 	}
 	menuItemsLock.Lock()
 	delete(menuItems, item.id)
 	menuItemsLock.Unlock()
+
+	// Turn the parent back into a plain item once its submenu is empty,
+	// so that it doesn't show an arrow to an empty flyout
+	if parent := item.parentItem(); parent != nil && !parent.hasChildren() {
+		if err := wt.removeSubMenu(parent.id, parent.parentId()); err != nil {
+			logf("systray error: failed to remove empty submenu: %s\n", err)
+		}
+	}
+}
+
+// Return whether the menu item has children in its submenu, including hidden ones.
+func (item *MenuItem) hasChildren() bool {
+	menuItemsLock.RLock()
+	defer menuItemsLock.RUnlock()
+	for _, child := range menuItems {
+		if child.parentItem() == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Return whether the menu item has a submenu, i.e. whether items have been added to it.
+func (item *MenuItem) HasSubMenu() bool {
+	wt.muMenus.RLock()
+	defer wt.muMenus.RUnlock()
+	_, exists := wt.menus[item.id]
+	return exists
 }
 
 // Show a previously hidden menu item.
 func (item *MenuItem) Show() {
+	item.mu.Lock()
+	item.hidden = false
+	item.mu.Unlock()
 	addOrUpdateMenuItem(item)
 }
 
 // Return if the menu item has a check mark.
 func (item *MenuItem) Checked() bool {
+	item.mu.RLock()
+	defer item.mu.RUnlock()
 	return item.checked
 }
 
 // Check a menu item regardless if it's previously checked or not.
 func (item *MenuItem) Check() {
+	item.mu.Lock()
 	item.checked = true
+	item.checkable = true
+	item.mu.Unlock()
 	item.update()
 }
 
 // Uncheck a menu item regardless if it's previously unchecked or not.
 func (item *MenuItem) Uncheck() {
+	item.mu.Lock()
 	item.checked = false
+	item.checkable = true
+	item.mu.Unlock()
+	item.update()
+}
+
+// Check or uncheck a menu item, e.g. to reflect a boolean setting.
+func (item *MenuItem) SetChecked(checked bool) {
+	item.mu.Lock()
+	item.checked = checked
+	item.checkable = true
+	item.mu.Unlock()
+	item.update()
+}
+
+// Attach arbitrary data to the menu item, e.g. for a callback shared by many items.
+func (item *MenuItem) SetData(data any) {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	item.data = data
+}
+
+// Return the data attached with SetData, or nil.
+func (item *MenuItem) Data() any {
+	item.mu.RLock()
+	defer item.mu.RUnlock()
+	return item.data
+}
+
+// Check the menu item if it's unchecked or uncheck it if it's checked,
+// and return whether it's now checked.
+func (item *MenuItem) ToggleChecked() bool {
+	item.mu.Lock()
+	item.checked = !item.checked
+	item.checkable = true
+	checked := item.checked
+	item.mu.Unlock()
 	item.update()
+	return checked
+}
+
+// Set whether the check mark of the menu item is shown as a radio dot.
+// Radio items don't show their icon, since it would hide the dot.
+// Unchecking the other items of the group is left to the application.
+func (item *MenuItem) SetRadio(radio bool) {
+	item.mu.Lock()
+	item.radio = radio
+	item.checkable = item.checkable || radio
+	item.mu.Unlock()
+	item.update()
+}
+
+// Return whether the check mark of the menu item is shown as a radio dot.
+func (item *MenuItem) Radio() bool {
+	item.mu.RLock()
+	defer item.mu.RUnlock()
+	return item.radio
+}
+
+// Add a new menu item, forgetting it again if that fails.
+func (item *MenuItem) add() error {
+	menuItemsLock.Lock()
+	menuItems[item.id] = item
+	menuItemsLock.Unlock()
+	if err := item.apply(); err != nil {
+		menuItemsLock.Lock()
+		delete(menuItems, item.id)
+		menuItemsLock.Unlock()
+		return fmt.Errorf("failed to add menu item: %w", err)
+	}
+	return nil
 }
 
 // Update a menu item with new properties.
@@ -358,6 +1157,9 @@ func (item *MenuItem) update() {
 
 // Contains information about loaded resources
 type winTray struct {
+	// Win32 menu functions
+	api menuAPI
+
 	instance,
 	icon,
 	cursor,
@@ -369,7 +1171,7 @@ type winTray struct {
 	// which corresponds to the main popup menu.
 	menus   map[uint32]windows.Handle
 	muMenus sync.RWMutex
-	// menuOf keeps track of the menu each menu item belongs to.
+	// menuOf keeps track of the menu each shown menu item is in.
 	menuOf   map[uint32]windows.Handle
 	muMenuOf sync.RWMutex
 	// menuItemIcons maintains the bitmap of each menu item (if applies). It's
@@ -379,18 +1181,56 @@ type winTray struct {
 	muMenuItemIcons sync.RWMutex
 	visibleItems    map[uint32][]uint32
 	muVisibleItems  sync.RWMutex
+	// muMenuUpdate serializes changes to the menus, so that the position of
+	// an item computed from visibleItems is still valid when it is inserted.
+	muMenuUpdate sync.Mutex
 
 	nid   *notifyIconData
 	muNID sync.RWMutex
-	wcex  *wndClassEx
+	// Whether or not the icon has been added to the notification area
+	iconAdded bool
+	// Icon set by the application, which may differ from nid.Icon during animations
+	trayIcon windows.Handle
+	// Icon created from an image for the tray, to be destroyed when replaced
+	ownedIcon windows.Handle
+	// Content of the icon if it was set with SetIcon, nil otherwise
+	trayIconBytes []byte
+	// Timer of the update throttle interval, and whether changes are waiting for it
+	modifyTimer   *time.Timer
+	modifyPending bool
+
+	wcex *wndClassEx
 
 	wmSystrayMessage,
+	wmRunOnLoop,
 	wmTaskbarCreated uint32
 
+	// ID of the thread that owns the window and runs the message loop
+	threadID uint32
+	// Functions waiting to be run on the message loop thread
+	loopFuncs   []func()
+	muLoopFuncs sync.Mutex
+
+	// Closes the menu when it is left idle; only used on the message loop thread
+	menuTimer   *time.Timer
+	menuTimeout time.Duration
+	// Menu item currently highlighted, and grayed item clicked while the menu was open;
+	// only used on the message loop thread
+	hotItem, grayedClick uint32
+	// Position where the menu was last shown; only used on the message loop thread
+	menuPos Point
+	// Whether or not the icon was right-clicked with the mouse, so that the WM_CONTEXTMENU
+	// following WM_RBUTTONUP isn't taken for the keyboard; only used on the message loop thread
+	rightButtonUp bool
+	// Whether or not the menu is being shown
+	menuOpen atomic.Bool
+	// Size of the menu item icons when they were drawn; only used on the message loop thread
+	menuIconSize Point
+
 	initialized atomic.Bool
 }
 
-var wt = winTray{}
+var wt = winTray{api: win32MenuAPI{}}
 
 // Check if the tray as already been initialized.
 // Not goroutine safe with in regard to the initialization function,
@@ -400,82 +1240,217 @@ func (t *winTray) isReady() bool {
 }
 
 // Loads an image from file and shows it in the tray.
+// iconBytes is the content of the file if it was given by the application, or nil.
 // Shell_NotifyIcon: https://msdn.microsoft.com/en-us/library/windows/desktop/bb762159(v=vs.85).aspx
-func (t *winTray) setIcon(src string) error {
+func (t *winTray) setIcon(src string, iconBytes []byte) error {
 	if !wt.isReady() {
 		return ErrTrayNotReadyYet
 	}
-
-	const NIF_ICON = 0x00000002
+	if quitting.Load() {
+		return ErrTrayQuitting
+	}
 
 	h, err := t.loadIconFrom(src)
 	if err != nil {
-		return err
+		fallback := fallbackIconPath.Load()
+		if fallback == nil || *fallback == src {
+			return err
+		}
+		logf("systray error: failed to load icon %s, using the fallback icon: %s\n", src, err)
+		h, err = t.loadIconFrom(*fallback)
+		if err != nil {
+			return fmt.Errorf("failed to load fallback icon: %w", err)
+		}
+		iconBytes = nil
 	}
+	return t.setTrayIcon(h, false, iconBytes)
+}
 
+// Set the icon shown in the tray. If owned is true, the icon was created
+// just for the tray and is destroyed when it is replaced.
+// iconBytes is the content of the icon if it was set with SetIcon, or nil.
+// A running animation ends, so that it doesn't hide the new icon.
+func (t *winTray) setTrayIcon(h windows.Handle, owned bool, iconBytes []byte) error {
+	if quitting.Load() {
+		if owned {
+			pDestroyIcon.Call(uintptr(h))
+		}
+		return ErrTrayQuitting
+	}
+	// The animation needs muNID to restore the icon when it stops
+	stopIconAnimation()
 	t.muNID.Lock()
 	defer t.muNID.Unlock()
+	oldOwnedIcon := t.ownedIcon
+	t.trayIcon = h
+	t.trayIconBytes = iconBytes
+	t.ownedIcon = 0
+	if owned {
+		t.ownedIcon = h
+	}
+	err := t.showIcon(h)
+	if oldOwnedIcon != 0 && oldOwnedIcon != h {
+		pDestroyIcon.Call(uintptr(oldOwnedIcon))
+	}
+	return err
+}
+
+// Show an icon in the tray without changing the icon set by the application,
+// e.g. for animations. Must be called with muNID held.
+func (t *winTray) showIcon(h windows.Handle) error {
+	const NIF_ICON = 0x00000002
+
 	t.nid.Icon = h
 	t.nid.Flags |= NIF_ICON
 	t.nid.Size = uint32(unsafe.Sizeof(*t.nid))
 
-	return t.nid.modify()
+	return t.modifyIcon()
 }
 
 // WindowProc callback function that processes messages sent to a window.
 // https://msdn.microsoft.com/en-us/library/windows/desktop/ms633573(v=vs.85).aspx
 func (t *winTray) wndProc(hWnd windows.Handle, message uint32, wParam, lParam uintptr) (lResult uintptr) {
 	const (
-		WM_RBUTTONUP  = 0x0205
-		WM_LBUTTONUP  = 0x0202
-		WM_COMMAND    = 0x0111
-		WM_ENDSESSION = 0x0016
-		WM_CLOSE      = 0x0010
-		WM_DESTROY    = 0x0002
+		WM_COMMAND           = 0x0111
+		WM_ENDSESSION        = 0x0016
+		WM_QUERYENDSESSION   = 0x0011
+		WM_MENUSELECT        = 0x011F
+		WM_HOTKEY            = 0x0312
+		WM_POWERBROADCAST    = 0x0218
+		WM_WTSSESSION_CHANGE = 0x02B1
+		WM_DISPLAYCHANGE     = 0x007E
+		WM_SETTINGCHANGE     = 0x001A
+		WM_CLIPBOARDUPDATE   = 0x031D
+		WM_CLOSE             = 0x0010
+		WM_DESTROY           = 0x0002
+		NIN_POPUPOPEN        = 0x0406 // WM_USER + 6
+		WM_CONTEXTMENU       = 0x007B
+		WM_RBUTTONUP         = 0x0205
 	)
 	switch message {
 	case WM_COMMAND:
 		menuItemId := int32(wParam)
 		// https://docs.microsoft.com/en-us/windows/win32/menurc/wm-command#menus
 		if menuItemId != -1 {
-			id := uint32(wParam)
-			menuItemsLock.RLock()
-			item, ok := menuItems[id]
-			menuItemsLock.RUnlock()
-			if !ok {
-				log.Printf("systray error: no menu item with ID %d\n", id)
-				return
-			}
-			if item.onClick != nil {
-				go item.onClick()
-			}
+			t.menuCommand(uint32(wParam))
+		}
+	case WM_HOTKEY:
+		t.handleHotkey(uint32(wParam))
+	case WM_POWERBROADCAST:
+		t.handlePowerBroadcast(wParam)
+		lResult = 1
+	case WM_WTSSESSION_CHANGE:
+		t.handleSessionChange(wParam)
+	case WM_DISPLAYCHANGE:
+		t.handleDisplayChange()
+	case WM_SETTINGCHANGE:
+		t.refreshMenuItemIcons()
+	case WM_CLIPBOARDUPDATE:
+		t.handleClipboardUpdate()
+	case WM_MENUSELECT:
+		// The user is interacting with the menu, so restart the idle timeout
+		if t.menuTimer != nil {
+			t.menuTimer.Reset(t.menuTimeout)
+		}
+		// https://learn.microsoft.com/en-us/windows/win32/menurc/wm-menuselect
+		const MF_POPUP = 0x0010
+		t.hotItem = 0
+		if flags := uint16(wParam >> 16); flags != 0xFFFF && flags&MF_POPUP == 0 {
+			t.hotItem = uint32(uint16(wParam))
+		}
+	case WM_QUERYENDSESSION:
+		callbacksLock.RLock()
+		f := queryEndSessionCallback
+		callbacksLock.RUnlock()
+		lResult = 1
+		if f != nil && !f() {
+			lResult = 0
 		}
 	case WM_CLOSE:
 		pDestroyWindow.Call(uintptr(t.window))
 		t.wcex.unregister()
 	case WM_DESTROY:
+		t.unregisterHotkeys()
+		t.unregisterSessionNotification()
+		t.removeClipboardListener()
+		deleteMenuBackground()
 		// same as WM_ENDSESSION, but throws 0 exit code after all
 		defer pPostQuitMessage.Call(uintptr(int32(0)))
 		fallthrough
 	case WM_ENDSESSION:
+		if message == WM_ENDSESSION && wParam == 0 {
+			// The session isn't ending after all
+			break
+		}
 		t.muNID.Lock()
 		if t.nid != nil {
 			t.nid.delete()
 		}
 		t.muNID.Unlock()
-		systrayExitOnce.Do(systrayExit)
+		systrayExitOnce.Do(runOnExit)
 	case t.wmSystrayMessage:
-		if (lParam == WM_RBUTTONUP && openOnRightClick) ||
-			(lParam == WM_LBUTTONUP && openOnLeftClick) {
-			for _, f := range trayOpenedCallbacks {
-				f()
+		// With NOTIFYICON_VERSION_4, the low word of lParam holds the event
+		// and the high word the ID of the icon
+		event := lParam & 0xFFFF
+		if uint16(lParam>>16) != uint16(iconID.Load()) {
+			break
+		}
+		if event == NIN_POPUPOPEN {
+			// The tooltip is about to be shown
+			t.refreshTooltip()
+			break
+		}
+		if event == WM_RBUTTONUP {
+			// WM_CONTEXTMENU follows and is handled as the right click
+			t.rightButtonUp = true
+			break
+		}
+		keyboard := event == NIN_KEYSELECT || event == WM_CONTEXTMENU && !t.rightButtonUp
+		if event == WM_CONTEXTMENU {
+			t.rightButtonUp = false
+		}
+		if !interactive.Load() {
+			break
+		}
+		if t.handleClick(event) {
+			trayOpenedCallbacksLock.RLock()
+			callbacks := trayOpenedCallbacks
+			trayOpenedCallbacksLock.RUnlock()
+			for _, cb := range callbacks {
+				cb.f()
+			}
+			if keyboard {
+				// Opened with the keyboard, so show the menu at the icon,
+				// whose position is in wParam, rather than at the cursor.
+				// The queued key press is handled by the menu loop and highlights
+				// the first item, so that Enter and the arrow keys work right away.
+				const (
+					WM_KEYDOWN = 0x0100
+					VK_DOWN    = 0x28
+				)
+				pPostMessage.Call(uintptr(t.window), WM_KEYDOWN, VK_DOWN, 0)
+				t.showMenuAt(Point{X: int32(int16(wParam)), Y: int32(int16(wParam >> 16))})
+				// Give the focus back to the notification area for further keyboard navigation
+				// https://learn.microsoft.com/en-us/windows/win32/api/shellapi/nf-shellapi-shell_notifyiconw#remarks
+				t.muNID.Lock()
+				t.nid.setFocus()
+				t.muNID.Unlock()
+			} else {
+				t.showMenu()
 			}
-			t.showMenu()
+		}
+	case t.wmRunOnLoop:
+		t.muLoopFuncs.Lock()
+		funcs := t.loopFuncs
+		t.loopFuncs = nil
+		t.muLoopFuncs.Unlock()
+		for _, f := range funcs {
+			f()
 		}
 	case t.wmTaskbarCreated: // on explorer.exe restarts
-		t.muNID.Lock()
-		t.nid.add()
-		t.muNID.Unlock()
+		if err := t.recreateIcon(); err != nil {
+			logf("systray error: failed to add icon after taskbar restart: %s\n", err)
+		}
 	default:
 		// Calls the default window procedure to provide default processing for any window messages that an application does not process.
 		// https://msdn.microsoft.com/en-us/library/windows/desktop/ms633572(v=vs.85).aspx
@@ -490,7 +1465,7 @@ func (t *winTray) wndProc(hWnd windows.Handle, message uint32, wParam, lParam ui
 }
 
 // Register the window class and create the window for the event loop.
-func (t *winTray) initInstance() error {
+func (t *winTray) initInstance(cfg Config) error {
 	const IDI_APPLICATION = 32512
 	const IDC_ARROW = 32512 // Standard arrow
 	// https://msdn.microsoft.com/en-us/library/windows/desktop/ms633548(v=vs.85).aspx
@@ -512,17 +1487,26 @@ func (t *winTray) initInstance() error {
 		CS_HREDRAW = 0x0002
 		CS_VREDRAW = 0x0001
 	)
-	const NIF_MESSAGE = 0x00000001
+	const (
+		NIF_MESSAGE          = 0x00000001
+		NIF_ICON             = 0x00000002
+		NIF_TIP              = 0x00000004
+		NIF_SHOWTIP          = 0x00000080
+		NOTIFYICON_VERSION_4 = 4
+	)
 
 	// https://msdn.microsoft.com/en-us/library/windows/desktop/ms644931(v=vs.85).aspx
 	const WM_USER = 0x0400
 
-	const (
-		className  = "SystrayClass"
-		windowName = ""
-	)
+	className := cfg.ClassName
+	if className == "" {
+		className = "SystrayClass"
+	}
+	windowName := cfg.AppName
 
 	t.wmSystrayMessage = WM_USER + 1
+	t.wmRunOnLoop = WM_USER + 2
+	t.threadID = windows.GetCurrentThreadId()
 	t.visibleItems = make(map[uint32][]uint32)
 	t.menus = make(map[uint32]windows.Handle)
 	t.menuOf = make(map[uint32]windows.Handle)
@@ -609,77 +1593,133 @@ func (t *winTray) initInstance() error {
 		uintptr(t.window),
 	)
 
+	t.registerSessionNotification()
+
 	t.muNID.Lock()
 	defer t.muNID.Unlock()
 	t.nid = &notifyIconData{
 		Wnd:             windows.Handle(t.window),
-		ID:              100,
-		Flags:           NIF_MESSAGE,
+		ID:              iconID.Load(),
+		Flags:           NIF_MESSAGE | NIF_SHOWTIP,
 		CallbackMessage: t.wmSystrayMessage,
+		Version:         NOTIFYICON_VERSION_4,
 	}
 	t.nid.Size = uint32(unsafe.Sizeof(*t.nid))
-
-	err = t.nid.add()
+	if len(cfg.Icon) > 0 {
+		iconFilePath, err := iconBytesToFilePath(cfg.Icon)
+		if err != nil {
+			return fmt.Errorf("failed to write icon data to temp file: %w", err)
+		}
+		h, err := t.loadIcon(iconFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to load icon: %w", err)
+		}
+		t.nid.Icon = h
+		t.nid.Flags |= NIF_ICON
+		t.trayIcon = h
+		t.trayIconBytes = append([]byte(nil), cfg.Icon...)
+	}
+	if cfg.Tooltip != "" {
+		if err := t.nid.setTip(tooltipText(cfg.Tooltip)); err != nil {
+			return err
+		}
+		t.nid.Flags |= NIF_TIP
+	}
+
+	if cfg.Hidden {
+		return nil
+	}
+	err = t.nid.add()
 	if err != nil {
 		return fmt.Errorf("failed to create taskbar icon: %w", err)
 	}
+	t.iconAdded = true
+	runIconAdded()
 	return nil
 }
 
-// Create the main popup menu.
-func (t *winTray) createMenu() error {
-	const MIM_APPLYTOSUBMENUS = 0x80000000 // Settings apply to the menu and all of its submenus
+// Set the hidden state of the tray icon. Must be called with muNID held.
+func (t *winTray) setIconHidden(hidden bool) error {
+	const NIF_STATE = 0x00000008
+	const NIS_HIDDEN = 0x00000001
+	t.nid.Flags |= NIF_STATE
+	t.nid.StateMask = NIS_HIDDEN
+	if hidden {
+		t.nid.State = NIS_HIDDEN
+	} else {
+		t.nid.State = 0
+	}
+	return t.modifyIcon()
+}
 
-	menuHandle, _, err := pCreatePopupMenu.Call()
-	if menuHandle == 0 {
-		return err
+// Apply changes to the tray icon if it is shown.
+// The changes are applied later by ShowTrayIcon otherwise.
+// Must be called with muNID held.
+func (t *winTray) modifyIcon() error {
+	if !t.iconAdded {
+		return nil
+	}
+	if d := time.Duration(updateThrottle.Load()); d > 0 {
+		return t.throttleModify(d)
 	}
-	t.menus[0] = windows.Handle(menuHandle)
+	return t.nid.modify()
+}
 
-	// https://msdn.microsoft.com/en-us/library/windows/desktop/ms647575(v=vs.85).aspx
-	mi := struct {
-		Size, Mask, Style, Max uint32
-		Background             windows.Handle
-		ContextHelpID          uint32
-		MenuData               uintptr
-	}{
-		Mask: MIM_APPLYTOSUBMENUS,
+// Create the main popup menu.
+// The caller must hold muMenus.
+func (t *winTray) createMenu() error {
+	menu, err := t.api.CreatePopupMenu()
+	if err != nil {
+		return err
 	}
-	mi.Size = uint32(unsafe.Sizeof(mi))
+	t.menus[0] = menu
+	t.menuIconSize = menuIconSize()
+	return t.setMenuInfo(t.menus[0])
+}
 
-	res, _, err := pSetMenuInfo.Call(
-		uintptr(t.menus[0]),
-		uintptr(unsafe.Pointer(&mi)),
+// Apply the menu settings to a menu and its submenus.
+func (t *winTray) setMenuInfo(menu windows.Handle) error {
+	const (
+		MIM_APPLYTOSUBMENUS = 0x80000000 // Settings apply to the menu and all of its submenus
+		MIM_MAXHEIGHT       = 0x00000001
+		MIM_BACKGROUND      = 0x00000002
 	)
-	if res == 0 {
-		return err
+
+	mi := menuInfo{
+		Mask: MIM_APPLYTOSUBMENUS | MIM_MAXHEIGHT,
+		Max:  menuMaxHeight.Load(),
 	}
-	return nil
+	if brush := menuBackground.Load(); brush != 0 {
+		mi.Mask |= MIM_BACKGROUND
+		mi.Background = windows.Handle(brush)
+	}
+	return t.api.SetMenuInfo(menu, &mi)
 }
 
 // Create a submenu for a menu item.
 func (t *winTray) convertToSubMenu(menuItemId uint32) (windows.Handle, error) {
 	const MIIM_SUBMENU = 0x00000004
 
-	res, _, err := pCreateMenu.Call()
-	if res == 0 {
+	menu, err := t.api.CreateMenu()
+	if err != nil {
+		return 0, err
+	}
+	if err := t.setMenuInfo(menu); err != nil {
 		return 0, err
 	}
-	menu := windows.Handle(res)
 
-	mi := menuItemInfo{Mask: MIIM_SUBMENU, SubMenu: menu}
-	mi.Size = uint32(unsafe.Sizeof(mi))
+	// Only the submenu is set, so the title, state and bitmap of the item are kept.
+	// When the item is inserted again, e.g. after being hidden,
+	// addOrUpdateMenuItem sets the submenu together with the bitmap.
 	t.muMenuOf.RLock()
-	hMenu := t.menuOf[menuItemId]
+	hMenu, inMenu := t.menuOf[menuItemId]
 	t.muMenuOf.RUnlock()
-	res, _, err = pSetMenuItemInfo.Call(
-		uintptr(hMenu),
-		uintptr(menuItemId),
-		0,
-		uintptr(unsafe.Pointer(&mi)),
-	)
-	if res == 0 {
-		return 0, err
+	if inMenu {
+		mi := menuItemInfo{Mask: MIIM_SUBMENU, SubMenu: menu}
+		err = t.api.SetMenuItemInfo(hMenu, menuItemId, &mi)
+		if err != nil {
+			return 0, err
+		}
 	}
 	t.muMenus.Lock()
 	t.menus[menuItemId] = menu
@@ -688,10 +1728,12 @@ func (t *winTray) convertToSubMenu(menuItemId uint32) (windows.Handle, error) {
 }
 
 // Add or update a menu item.
-func (t *winTray) addOrUpdateMenuItem(menuItemId uint32, parentId uint32, title string, disabled, checked bool) error {
+func (t *winTray) addOrUpdateMenuItem(menuItemId uint32, parentId uint32, title string, disabled, checked, radio bool) error {
 	if !wt.isReady() {
 		return ErrTrayNotReadyYet
 	}
+	t.muMenuUpdate.Lock()
+	defer t.muMenuUpdate.Unlock()
 
 	// https://msdn.microsoft.com/en-us/library/windows/desktop/ms647578(v=vs.85).aspx
 	const (
@@ -702,10 +1744,13 @@ func (t *winTray) addOrUpdateMenuItem(menuItemId uint32, parentId uint32, title
 		MIIM_ID      = 0x00000002
 		MIIM_STATE   = 0x00000001
 	)
-	const MFT_STRING = 0x00000000
+	const (
+		MFT_STRING     = 0x00000000
+		MFT_RADIOCHECK = 0x00000200
+	)
 	const (
 		MFS_CHECKED  = 0x00000008
-		MFS_DISABLED = 0x00000003
+		MFS_DISABLED = 0x00000003 // same as MFS_GRAYED
 	)
 	titlePtr, err := windows.UTF16PtrFromString(title)
 	if err != nil {
@@ -719,22 +1764,26 @@ func (t *winTray) addOrUpdateMenuItem(menuItemId uint32, parentId uint32, title
 		TypeData: titlePtr,
 		Cch:      uint32(len(title)),
 	}
-	mi.Size = uint32(unsafe.Sizeof(mi))
 	if disabled {
 		mi.State |= MFS_DISABLED
 	}
 	if checked {
 		mi.State |= MFS_CHECKED
 	}
-	t.muMenuItemIcons.RLock()
-	hIcon := t.menuItemIcons[menuItemId]
-	t.muMenuItemIcons.RUnlock()
-	if hIcon > 0 {
-		mi.Mask |= MIIM_BITMAP
-		mi.BMPItem = hIcon
+	var hIcon windows.Handle
+	if radio {
+		// A bitmap would be drawn instead of the radio dot
+		mi.Type |= MFT_RADIOCHECK
+	} else {
+		t.muMenuItemIcons.RLock()
+		hIcon = t.menuItemIcons[menuItemId]
+		t.muMenuItemIcons.RUnlock()
 	}
+	// Always set the bitmap so that a removed icon is cleared
+	mi.Mask |= MIIM_BITMAP
+	mi.BMPItem = hIcon
 
-	var res uintptr
+	updated := false
 	t.muMenus.RLock()
 	menu, exists := t.menus[parentId]
 	t.muMenus.RUnlock()
@@ -747,16 +1796,16 @@ func (t *winTray) addOrUpdateMenuItem(menuItemId uint32, parentId uint32, title
 		t.menus[parentId] = menu
 		t.muMenus.Unlock()
 	} else if t.getVisibleItemIndex(parentId, menuItemId) != -1 {
-		// We set the menu item info based on the menuID
-		res, _, err = pSetMenuItemInfo.Call(
-			uintptr(menu),
-			uintptr(menuItemId),
-			0,
-			uintptr(unsafe.Pointer(&mi)),
-		)
+		// We set the menu item info based on the menuID.
+		// The item is already in the menu, so inserting it again on failure
+		// would shift the positions of the items after it.
+		if err := t.api.SetMenuItemInfo(menu, menuItemId, &mi); err != nil {
+			return err
+		}
+		updated = true
 	}
 
-	if res == 0 {
+	if !updated {
 		// Menu item does not already exist, create it
 		t.muMenus.RLock()
 		submenu, exists := t.menus[menuItemId]
@@ -767,13 +1816,8 @@ func (t *winTray) addOrUpdateMenuItem(menuItemId uint32, parentId uint32, title
 		}
 		t.addToVisibleItems(parentId, menuItemId)
 		position := t.getVisibleItemIndex(parentId, menuItemId)
-		res, _, err = pInsertMenuItem.Call(
-			uintptr(menu),
-			uintptr(position),
-			1,
-			uintptr(unsafe.Pointer(&mi)),
-		)
-		if res == 0 {
+		err = t.api.InsertMenuItem(menu, position, &mi)
+		if err != nil {
 			t.delFromVisibleItems(parentId, menuItemId)
 			return err
 		}
@@ -790,6 +1834,8 @@ func (t *winTray) addSeparatorMenuItem(menuItemId, parentId uint32) error {
 	if !wt.isReady() {
 		return ErrTrayNotReadyYet
 	}
+	t.muMenuUpdate.Lock()
+	defer t.muMenuUpdate.Unlock()
 
 	// https://msdn.microsoft.com/en-us/library/windows/desktop/ms647578(v=vs.85).aspx
 	const (
@@ -804,23 +1850,32 @@ func (t *winTray) addSeparatorMenuItem(menuItemId, parentId uint32) error {
 		Type: MFT_SEPARATOR,
 		ID:   uint32(menuItemId),
 	}
+	if t.getVisibleItemIndex(parentId, menuItemId) != -1 {
+		// Separators have nothing to update
+		return nil
+	}
 
-	mi.Size = uint32(unsafe.Sizeof(mi))
-
-	t.addToVisibleItems(parentId, menuItemId)
-	position := t.getVisibleItemIndex(parentId, menuItemId)
 	t.muMenus.RLock()
-	menu := uintptr(t.menus[parentId])
+	menu, exists := t.menus[parentId]
 	t.muMenus.RUnlock()
-	res, _, err := pInsertMenuItem.Call(
-		menu,
-		uintptr(position),
-		1,
-		uintptr(unsafe.Pointer(&mi)),
-	)
-	if res == 0 {
+	if !exists {
+		// The separator is the first item of a submenu
+		var err error
+		menu, err = t.convertToSubMenu(parentId)
+		if err != nil {
+			return err
+		}
+	}
+	t.addToVisibleItems(parentId, menuItemId)
+	position := t.getVisibleItemIndex(parentId, menuItemId)
+	err := t.api.InsertMenuItem(menu, position, &mi)
+	if err != nil {
+		t.delFromVisibleItems(parentId, menuItemId)
 		return err
 	}
+	t.muMenuOf.Lock()
+	t.menuOf[menuItemId] = menu
+	t.muMenuOf.Unlock()
 
 	return nil
 }
@@ -830,19 +1885,14 @@ func (t *winTray) removeMenuItem(menuItemId, parentId uint32) error {
 	if !wt.isReady() {
 		return ErrTrayNotReadyYet
 	}
-
-	const MF_BYCOMMAND = 0x00000000
-	const ERROR_SUCCESS syscall.Errno = 0
+	t.muMenuUpdate.Lock()
+	defer t.muMenuUpdate.Unlock()
 
 	t.muMenus.RLock()
-	menu := uintptr(t.menus[parentId])
+	menu := t.menus[parentId]
 	t.muMenus.RUnlock()
-	res, _, err := pDeleteMenu.Call(
-		menu,
-		uintptr(menuItemId),
-		MF_BYCOMMAND,
-	)
-	if res == 0 && err.(syscall.Errno) != ERROR_SUCCESS {
+	err := t.api.DeleteMenu(menu, menuItemId)
+	if err != nil {
 		return err
 	}
 	t.delFromVisibleItems(parentId, menuItemId)
@@ -850,27 +1900,57 @@ func (t *winTray) removeMenuItem(menuItemId, parentId uint32) error {
 	return nil
 }
 
+// Detach and destroy the submenu of a menu item, if it has one.
+func (t *winTray) removeSubMenu(menuItemId, parentId uint32) error {
+	if !wt.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	t.muMenuUpdate.Lock()
+	defer t.muMenuUpdate.Unlock()
+
+	const MIIM_SUBMENU = 0x00000004
+	t.muMenus.Lock()
+	submenu, exists := t.menus[menuItemId]
+	delete(t.menus, menuItemId)
+	t.muMenus.Unlock()
+	if !exists {
+		return nil
+	}
+	if t.getVisibleItemIndex(parentId, menuItemId) != -1 {
+		t.muMenus.RLock()
+		menu := t.menus[parentId]
+		t.muMenus.RUnlock()
+		mi := menuItemInfo{Mask: MIIM_SUBMENU}
+		if err := t.api.SetMenuItemInfo(menu, menuItemId, &mi); err != nil {
+			return err
+		}
+	}
+	t.muVisibleItems.Lock()
+	delete(t.visibleItems, menuItemId)
+	t.muVisibleItems.Unlock()
+	return t.api.DestroyMenu(submenu)
+}
+
 // Hide a menu item.
 func (t *winTray) hideMenuItem(menuItemId, parentId uint32) error {
 	if !wt.isReady() {
 		return ErrTrayNotReadyYet
 	}
-
-	const MF_BYCOMMAND = 0x00000000
-	const ERROR_SUCCESS syscall.Errno = 0
+	t.muMenuUpdate.Lock()
+	defer t.muMenuUpdate.Unlock()
 
 	t.muMenus.RLock()
-	menu := uintptr(t.menus[parentId])
+	menu := t.menus[parentId]
 	t.muMenus.RUnlock()
-	res, _, err := pRemoveMenu.Call(
-		menu,
-		uintptr(menuItemId),
-		MF_BYCOMMAND,
-	)
-	if res == 0 && err.(syscall.Errno) != ERROR_SUCCESS {
+	err := t.api.RemoveMenu(menu, menuItemId)
+	if err != nil {
 		return err
 	}
 	t.delFromVisibleItems(parentId, menuItemId)
+	// The item isn't in a menu until it's shown again
+	t.muMenuOf.Lock()
+	delete(t.menuOf, menuItemId)
+	t.muMenuOf.Unlock()
 
 	return nil
 }
@@ -880,31 +1960,202 @@ func (t *winTray) showMenu() error {
 	if !wt.isReady() {
 		return ErrTrayNotReadyYet
 	}
-
-	const (
-		TPM_BOTTOMALIGN = 0x0020
-		TPM_LEFTALIGN   = 0x0000
-	)
-	p := point{}
+	p := Point{}
 	res, _, err := pGetCursorPos.Call(uintptr(unsafe.Pointer(&p)))
 	if res == 0 {
 		return err
 	}
-	pSetForegroundWindow.Call(uintptr(t.window))
+	return t.showMenuAt(p)
+}
+
+// Show the menu at the given screen position.
+func (t *winTray) showMenuAt(p Point) error {
+	const (
+		TPM_NONOTIFY  = 0x0080
+		TPM_RETURNCMD = 0x0100
+	)
+	t.menuPos = p
+	t.refreshEnabledItems()
+	t.muMenus.RLock()
+	menu := t.menus[0]
+	t.muMenus.RUnlock()
+	if headless.Load() {
+		// There's no menu to show
+		recordHeadless("TrackPopupMenu", menu, 0)
+		return nil
+	}
+	t.setForeground()
+
+	if d := time.Duration(menuAutoDismiss.Load()); d > 0 {
+		t.menuTimeout = d
+		t.menuTimer = time.AfterFunc(d, func() {
+			// Ends the modal menu loop of TrackPopupMenu
+			const WM_CANCELMODE = 0x001F
+			pPostMessage.Call(uintptr(t.window), WM_CANCELMODE, 0, 0)
+		})
+		defer func() {
+			t.menuTimer.Stop()
+			t.menuTimer = nil
+		}()
+	}
 
-	res, _, err = pTrackPopupMenu.Call(
-		uintptr(t.menus[0]),
-		TPM_BOTTOMALIGN|TPM_LEFTALIGN,
+	flags := menuAlignment(p)
+	returnCmd := menuReturnCmd.Load()
+	if returnCmd {
+		flags |= TPM_RETURNCMD | TPM_NONOTIFY
+	}
+	unhook := t.hookGrayedClicks()
+	t.menuOpen.Store(true)
+	res, _, err := pTrackPopupMenu.Call(
+		uintptr(menu),
+		flags,
 		uintptr(p.X),
 		uintptr(p.Y),
 		0,
 		uintptr(t.window),
 		0,
 	)
+	t.menuOpen.Store(false)
+	unhook()
+	callbacksLock.RLock()
+	onClosed := menuClosedCallback
+	callbacksLock.RUnlock()
+	if onClosed != nil {
+		go onClosed()
+	}
+	if t.grayedClick != 0 {
+		t.menuCommand(t.grayedClick)
+		t.grayedClick = 0
+	}
+	if err := t.menuResult(res, err, returnCmd); err != nil {
+		return err
+	}
+	if foregroundWorkaround.Load() {
+		// Make sure the menu closes properly the next time it's shown.
+		// https://support.microsoft.com/en-us/kb/135788
+		const WM_NULL = 0x0000
+		pPostMessage.Call(uintptr(t.window), WM_NULL, 0, 0)
+	}
+
+	return nil
+}
+
+// Handle the result of TrackPopupMenu, dispatching the chosen item
+// if it was returned rather than posted as WM_COMMAND.
+func (t *winTray) menuResult(res uintptr, err error, returnCmd bool) error {
+	if !returnCmd {
+		if res == 0 {
+			return err
+		}
+		return nil
+	}
+	// Zero means that the menu was dismissed without choosing an item
+	if res != 0 {
+		t.menuCommand(uint32(res))
+	}
+	return nil
+}
+
+// Handle a menu item chosen in the menu, showing the menu again if the item
+// is checkable and SetKeepOpenOnToggle is enabled.
+func (t *winTray) menuCommand(id uint32) {
+	t.dispatchCommand(id)
+	if !keepOpenOnToggle.Load() || !interactive.Load() {
+		return
+	}
+	menuItemsLock.RLock()
+	item, ok := menuItems[id]
+	menuItemsLock.RUnlock()
+	if !ok {
+		return
+	}
+	item.mu.RLock()
+	checkable := item.checkable
+	item.mu.RUnlock()
+	if checkable {
+		// Reopen once the current message has been handled, rather than nesting menu loops
+		pos := t.menuPos
+		err := t.postOnLoop(func() {
+			if err := t.showMenuAt(pos); err != nil {
+				logf("systray error: failed to reopen menu: %s\n", err)
+			}
+		})
+		if err != nil {
+			logf("systray error: failed to reopen menu: %s\n", err)
+		}
+	}
+}
+
+// Call the callback of the menu item that was clicked.
+func (t *winTray) dispatchCommand(id uint32) {
+	if !interactive.Load() {
+		return
+	}
+	menuItemsLock.RLock()
+	item, ok := menuItems[id]
+	menuItemsLock.RUnlock()
+	if !ok {
+		logf("systray error: no menu item with ID %d\n", id)
+		return
+	}
+	if onClick := item.callback(keyModifiers()); onClick != nil {
+		go onClick()
+	}
+}
+
+// Bring the tray window to the foreground so the menu receives keyboard input
+// and is dismissed when the user clicks elsewhere.
+// SetForegroundWindow is refused if our process isn't the foreground process,
+// so attach to the input of the foreground thread and try again.
+func (t *winTray) setForeground() {
+	res, _, _ := pSetForegroundWindow.Call(uintptr(t.window))
+	if res != 0 || !foregroundWorkaround.Load() {
+		return
+	}
+
+	fgWindow, _, _ := pGetForegroundWindow.Call()
+	fgThread, _, _ := pGetWindowThreadProcId.Call(fgWindow, 0)
+	thisThread := uintptr(windows.GetCurrentThreadId())
+	if fgThread != 0 && fgThread != thisThread {
+		pAttachThreadInput.Call(fgThread, thisThread, 1)
+		defer pAttachThreadInput.Call(fgThread, thisThread, 0)
+	}
+	res, _, err := pSetForegroundWindow.Call(uintptr(t.window))
 	if res == 0 {
+		logf("systray error: failed to set foreground window: %s\n", err)
+	}
+}
+
+// Run a function on the message loop thread and wait for it to return.
+// Functions that must be called by the thread owning the window go through here.
+func (t *winTray) runOnLoop(f func() error) error {
+	if !t.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	if quitting.Load() {
+		// The message loop may be gone already
+		return ErrTrayQuitting
+	}
+	if windows.GetCurrentThreadId() == t.threadID {
+		return f()
+	}
+	done := make(chan error, 1)
+	if err := t.postOnLoop(func() { done <- f() }); err != nil {
 		return err
 	}
+	return <-done
+}
 
+// Queue a function to be run on the message loop thread without waiting for it,
+// even if called from that thread.
+func (t *winTray) postOnLoop(f func()) error {
+	t.muLoopFuncs.Lock()
+	t.loopFuncs = append(t.loopFuncs, f)
+	t.muLoopFuncs.Unlock()
+	res, _, err := pPostMessage.Call(uintptr(t.window), uintptr(t.wmRunOnLoop), 0, 0)
+	if res == 0 {
+		return fmt.Errorf("failed to post to message loop: %w", err)
+	}
 	return nil
 }
 
@@ -925,13 +2176,26 @@ func (t *winTray) delFromVisibleItems(parent, val uint32) {
 func (t *winTray) addToVisibleItems(parent, val uint32) {
 	t.muVisibleItems.Lock()
 	defer t.muVisibleItems.Unlock()
-	if visibleItems, exists := t.visibleItems[parent]; !exists {
-		t.visibleItems[parent] = []uint32{val}
-	} else {
-		newvisible := append(visibleItems, val)
-		sort.Slice(newvisible, func(i, j int) bool { return newvisible[i] < newvisible[j] })
-		t.visibleItems[parent] = newvisible
+	// Keep the list in menu order and free of duplicates, so that the index of an item
+	// is its position in the menu
+	visibleItems := t.visibleItems[parent]
+	if OrderingMode(menuOrdering.Load()) == OrderByInsertion {
+		for _, id := range visibleItems {
+			if id == val {
+				return
+			}
+		}
+		t.visibleItems[parent] = append(visibleItems, val)
+		return
 	}
+	i := sort.Search(len(visibleItems), func(i int) bool { return visibleItems[i] >= val })
+	if i < len(visibleItems) && visibleItems[i] == val {
+		return
+	}
+	visibleItems = append(visibleItems, 0)
+	copy(visibleItems[i+1:], visibleItems[i:])
+	visibleItems[i] = val
+	t.visibleItems[parent] = visibleItems
 }
 
 // Get the index of the item ID in the list of visible items.
@@ -952,32 +2216,43 @@ func (t *winTray) loadIconFrom(src string) (windows.Handle, error) {
 	if !wt.isReady() {
 		return 0, ErrTrayNotReadyYet
 	}
+	return t.loadIcon(src)
+}
 
-	const IMAGE_ICON = 1               // Loads an icon
-	const LR_LOADFROMFILE = 0x00000010 // Loads the stand-alone image from the file
-	const LR_DEFAULTSIZE = 0x00000040  // Loads default-size icon for windows(SM_CXICON x SM_CYICON) if cx, cy are set to zero
+// Load the icon at index in an executable or DLL, reusing the handle if it was loaded before.
+func (t *winTray) loadExecutableIcon(path string, index int) (windows.Handle, error) {
+	if !wt.isReady() {
+		return 0, ErrTrayNotReadyYet
+	}
+	key := fmt.Sprintf("%s,%d", path, index)
+	t.muLoadedImages.RLock()
+	h, ok := t.loadedImages[key]
+	t.muLoadedImages.RUnlock()
+	if ok {
+		return h, nil
+	}
+	h, err := extractIcon(path, index)
+	if err != nil {
+		return 0, err
+	}
+	t.muLoadedImages.Lock()
+	t.loadedImages[key] = h
+	t.muLoadedImages.Unlock()
+	return h, nil
+}
 
+// Load an image from file without checking whether the tray is ready.
+func (t *winTray) loadIcon(src string) (windows.Handle, error) {
 	// Save and reuse handles of loaded images
 	t.muLoadedImages.RLock()
 	h, ok := t.loadedImages[src]
 	t.muLoadedImages.RUnlock()
 	if !ok {
-		srcPtr, err := windows.UTF16PtrFromString(src)
+		var err error
+		h, err = t.loadIconUncached(src)
 		if err != nil {
 			return 0, err
 		}
-		res, _, err := pLoadImage.Call(
-			0,
-			uintptr(unsafe.Pointer(srcPtr)),
-			IMAGE_ICON,
-			0,
-			0,
-			LR_LOADFROMFILE|LR_DEFAULTSIZE,
-		)
-		if res == 0 {
-			return 0, err
-		}
-		h = windows.Handle(res)
 		t.muLoadedImages.Lock()
 		t.loadedImages[src] = h
 		t.muLoadedImages.Unlock()
@@ -985,6 +2260,37 @@ func (t *winTray) loadIconFrom(src string) (windows.Handle, error) {
 	return h, nil
 }
 
+// Load an image from file into a new handle, e.g. because the file may have changed.
+// The caller owns the handle.
+func (t *winTray) loadIconUncached(src string) (windows.Handle, error) {
+	const IMAGE_ICON = 1               // Loads an icon
+	const LR_LOADFROMFILE = 0x00000010 // Loads the stand-alone image from the file
+	const LR_DEFAULTSIZE = 0x00000040  // Loads default-size icon for windows(SM_CXICON x SM_CYICON) if cx, cy are set to zero
+
+	// Pick the frame of the .ico file that suits the current DPI best
+	cx, cy := t.smallIconSize()
+	h, err := loadIconFileForSize(src, cx, cy)
+	if !errors.Is(err, errNotIconFile) {
+		return h, err
+	}
+	srcPtr, err := windows.UTF16PtrFromString(src)
+	if err != nil {
+		return 0, err
+	}
+	res, _, err := pLoadImage.Call(
+		0,
+		uintptr(unsafe.Pointer(srcPtr)),
+		IMAGE_ICON,
+		0,
+		0,
+		LR_LOADFROMFILE|LR_DEFAULTSIZE,
+	)
+	if res == 0 {
+		return 0, err
+	}
+	return windows.Handle(res), nil
+}
+
 // Convert an icon handle to a bitmap handle.
 func iconToBitmap(hIcon windows.Handle) (windows.Handle, error) {
 	const SM_CXSMICON = 49
@@ -1002,19 +2308,72 @@ func iconToBitmap(hIcon windows.Handle) (windows.Handle, error) {
 	defer pDeleteDC.Call(hMemDC)
 	cx, _, _ := pGetSystemMetrics.Call(SM_CXSMICON)
 	cy, _, _ := pGetSystemMetrics.Call(SM_CYSMICON)
-	hMemBmp, err := create32BitHBitmap(hMemDC, int32(cx), int32(cy))
+	hMemBmp, bits, err := create32BitHBitmap(hMemDC, int32(cx), int32(cy))
+	if err != nil {
+		return 0, err
+	}
+	// Start from fully transparent pixels, so that DrawIconEx blends the icon onto
+	// nothing and the menu background shows through where the icon is transparent
+	pixels := unsafe.Slice((*uint32)(bits), int(cx)*int(cy))
+	for i := range pixels {
+		pixels[i] = 0
+	}
 	hOriginalBmp, _, _ := pSelectObject.Call(hMemDC, hMemBmp)
-	defer pSelectObject.Call(hMemDC, hOriginalBmp)
 	res, _, err := pDrawIconEx.Call(hMemDC, 0, 0, uintptr(hIcon), cx, cy, 0, uintptr(0), DI_NORMAL)
+	pSelectObject.Call(hMemDC, hOriginalBmp)
 	if res == 0 {
+		pDeleteObject.Call(hMemBmp)
 		return 0, err
 	}
+	// Make sure GDI is done with the bitmap before touching its pixels
+	pGdiFlush.Call()
+
+	for _, p := range pixels {
+		if p&0xFF000000 != 0 {
+			return windows.Handle(hMemBmp), nil
+		}
+	}
+	// Legacy icons without an alpha channel rely on their AND mask for transparency
+	if err := applyIconMask(hMemDC, hIcon, int32(cx), int32(cy), pixels); err != nil {
+		pDeleteObject.Call(hMemBmp)
+		return 0, fmt.Errorf("failed to apply icon mask: %w", err)
+	}
 	return windows.Handle(hMemBmp), nil
 }
 
+// Set the alpha channel of icon pixels drawn without one from the icon's mask,
+// making the masked pixels transparent and the others opaque.
+func applyIconMask(hDC uintptr, hIcon windows.Handle, cx, cy int32, pixels []uint32) error {
+	const DI_MASK = 0x1
+	hMaskBmp, maskBits, err := create32BitHBitmap(hDC, cx, cy)
+	if err != nil {
+		return err
+	}
+	defer pDeleteObject.Call(hMaskBmp)
+	hOriginalBmp, _, _ := pSelectObject.Call(hDC, hMaskBmp)
+	res, _, err := pDrawIconEx.Call(hDC, 0, 0, uintptr(hIcon), uintptr(cx), uintptr(cy), 0, uintptr(0), DI_MASK)
+	pSelectObject.Call(hDC, hOriginalBmp)
+	if res == 0 {
+		return err
+	}
+	pGdiFlush.Call()
+
+	mask := unsafe.Slice((*uint32)(maskBits), len(pixels))
+	for i, m := range mask {
+		if m&0x00FFFFFF != 0 {
+			// White in the mask means transparent
+			pixels[i] = 0
+		} else {
+			pixels[i] |= 0xFF000000
+		}
+	}
+	return nil
+}
+
 // Create a 32-bit HBITMAP (for use in iconToBitmap).
+// Also returns a pointer to the bitmap's pixels, in bottom-up row order.
 // https://learn.microsoft.com/en-us/windows/win32/api/wingdi/nf-wingdi-createdibsection
-func create32BitHBitmap(hDC uintptr, cx, cy int32) (uintptr, error) {
+func create32BitHBitmap(hDC uintptr, cx, cy int32) (uintptr, unsafe.Pointer, error) {
 	const BI_RGB uint32 = 0
 	const DIB_RGB_COLORS = 0
 	bmi := bitmapInfo{
@@ -1027,7 +2386,7 @@ func create32BitHBitmap(hDC uintptr, cx, cy int32) (uintptr, error) {
 		},
 	}
 	bmi.BmiHeader.BiSize = uint32(unsafe.Sizeof(bmi.BmiHeader))
-	var bits uintptr
+	var bits unsafe.Pointer
 	hBitmap, _, err := pCreateDIBSection.Call(
 		hDC,
 		uintptr(unsafe.Pointer(&bmi)),
@@ -1037,22 +2396,16 @@ func create32BitHBitmap(hDC uintptr, cx, cy int32) (uintptr, error) {
 		0,
 	)
 	if hBitmap == 0 {
-		return 0, err
+		return 0, nil, err
 	}
-	return hBitmap, nil
+	return hBitmap, bits, nil
 }
 
 // Run the systray message loop.
 func nativeLoop() {
-	// MSG struct
-	var m = &struct {
-		WindowHandle windows.Handle
-		Message      uint32
-		Wparam       uintptr
-		Lparam       uintptr
-		Time         uint32
-		Pt           point
-	}{}
+	// onExit has run by the time WM_QUIT ends the loop
+	defer setDone()
+	m := &msg{}
 	for {
 		ret, _, err := pGetMessage.Call(uintptr(unsafe.Pointer(m)), 0, 0, 0)
 
@@ -1062,7 +2415,7 @@ func nativeLoop() {
 		// https://msdn.microsoft.com/en-us/library/windows/desktop/ms644936(v=vs.85).aspx
 		switch int32(ret) {
 		case -1:
-			log.Printf("systray error: message loop failure: %s\n", err)
+			logf("systray error: message loop failure: %s\n", err)
 			return
 		case 0:
 			return
@@ -1077,6 +2430,10 @@ func nativeLoop() {
 func quit() {
 	const WM_CLOSE = 0x0010
 
+	quitting.Store(true)
+	stopIconAnimation()
+	stopIconWatchers()
+
 	pPostMessage.Call(
 		uintptr(wt.window),
 		WM_CLOSE,
@@ -1089,17 +2446,63 @@ func quit() {
 		wt.nid.delete()
 	}
 	wt.muNID.Unlock()
-	systrayExitOnce.Do(systrayExit)
+	systrayExitOnce.Do(runOnExit)
+}
+
+// Set the directory where the icons given as bytes are written to be loaded,
+// e.g. the application's data directory if the temp directory is cleaned while the app runs.
+// The directory is created if needed. Pass "" to use the system temp directory again.
+// Icons that were already set keep their files.
+func SetIconTempDir(dir string) error {
+	if dir == "" {
+		iconTempDir.Store(nil)
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create icon directory: %w", err)
+	}
+	f, err := os.CreateTemp(dir, "systray_temp_icon_*.tmp")
+	if err != nil {
+		return fmt.Errorf("icon directory is not writable: %w", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	iconTempDir.Store(&dir)
+	return nil
 }
 
 // Write the icon bytes to a temp file and return the file path.
 func iconBytesToFilePath(iconBytes []byte) (string, error) {
-	bh := md5.Sum(iconBytes)
-	dataHash := hex.EncodeToString(bh[:])
-	iconFilePath := filepath.Join(os.TempDir(), "systray_temp_icon_"+dataHash)
+	// The hash is only used to deduplicate the files, so it doesn't need to be cryptographic
+	h := fnv.New128a()
+	h.Write(iconBytes)
+	dataHash := hex.EncodeToString(h.Sum(nil))
+	dir := os.TempDir()
+	if d := iconTempDir.Load(); d != nil {
+		dir = *d
+	}
+	iconFilePath := filepath.Join(dir, "systray_temp_icon_"+dataHash)
+
+	// Keep other goroutines from loading the file while it's being written
+	mu, _ := iconFileLocks.LoadOrStore(iconFilePath, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
 
 	if _, err := os.Stat(iconFilePath); os.IsNotExist(err) {
-		if err := os.WriteFile(iconFilePath, iconBytes, 0644); err != nil {
+		// Write to a temporary file first so that other processes never see a partial file
+		f, err := os.CreateTemp(filepath.Dir(iconFilePath), "systray_temp_icon_*.tmp")
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Write(iconBytes)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), iconFilePath)
+		}
+		if err != nil {
+			os.Remove(f.Name())
 			return "", err
 		}
 	}
@@ -1113,26 +2516,133 @@ func SetIcon(iconBytes []byte) error {
 	if err != nil {
 		return fmt.Errorf("failed to write icon data to temp file: %w", err)
 	}
-	if err := wt.setIcon(iconFilePath); err != nil {
+	if err := wt.setIcon(iconFilePath, append([]byte(nil), iconBytes...)); err != nil {
 		return fmt.Errorf("failed to set icon: %w", err)
 	}
 	return nil
 }
 
+// Return the content of the icon currently shown in the tray.
+// ok is false if the icon wasn't set from bytes, e.g. it was set from a file path or an image,
+// or if the fallback icon is shown. The returned slice must not be modified.
+func CurrentIcon() (iconBytes []byte, ok bool) {
+	wt.muNID.RLock()
+	defer wt.muNID.RUnlock()
+	return wt.trayIconBytes, wt.trayIconBytes != nil
+}
+
+// Set an icon to show instead when SetIcon or SetIconFromFilePath fails to load an icon,
+// so that the tray still shows something recognizable.
+// The failure is then logged rather than returned. Pass nil to remove the fallback icon.
+func SetFallbackIcon(iconBytes []byte) error {
+	if iconBytes == nil {
+		fallbackIconPath.Store(nil)
+		return nil
+	}
+	iconFilePath, err := iconBytesToFilePath(iconBytes)
+	if err != nil {
+		return fmt.Errorf("failed to write icon data to temp file: %w", err)
+	}
+	fallbackIconPath.Store(&iconFilePath)
+	return nil
+}
+
 // Set the systray icon from a file path.
 // iconFilePath should be the path to a .ico image.
 func SetIconFromFilePath(iconFilePath string) error {
-	return wt.setIcon(iconFilePath)
+	return wt.setIcon(iconFilePath, nil)
+}
+
+// Set the systray icon to the icon at index in an executable or DLL,
+// e.g. to represent another program.
+func SetIconFromExecutable(exePath string, index int) error {
+	if quitting.Load() {
+		return ErrTrayQuitting
+	}
+	h, err := wt.loadExecutableIcon(exePath, index)
+	if err != nil {
+		return fmt.Errorf("failed to extract icon: %w", err)
+	}
+	return wt.setTrayIcon(h, false, nil)
+}
+
+// Reset the systray icon to the icon of the executable,
+// or to the default application icon if the executable has none.
+func SetDefaultIcon() error {
+	if !wt.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	if quitting.Load() {
+		return ErrTrayQuitting
+	}
+	if exePath, err := os.Executable(); err == nil {
+		if h, err := extractIcon(exePath, 0); err == nil {
+			return wt.setTrayIcon(h, true, nil)
+		}
+	}
+	const IDI_APPLICATION = 32512
+	// The shared system icon must not be destroyed
+	h, _, err := pLoadIcon.Call(0, uintptr(IDI_APPLICATION))
+	if h == 0 {
+		return fmt.Errorf("failed to load default icon: %w", err)
+	}
+	return wt.setTrayIcon(windows.Handle(h), false, nil)
+}
+
+// Return the parent menu item or nil if it doesn't have a parent.
+func (item *MenuItem) parentItem() *MenuItem {
+	item.mu.RLock()
+	defer item.mu.RUnlock()
+	return item.parent
 }
 
 // Return the ID of the parent menu item or 0 if it doesn't have a parent.
 func (item *MenuItem) parentId() uint32 {
-	if item.parent != nil {
-		return uint32(item.parent.id)
+	if parent := item.parentItem(); parent != nil {
+		return uint32(parent.id)
 	}
 	return 0
 }
 
+// Move the menu item to the submenu of newParent, or to the top level menu if newParent is nil.
+// The item keeps its callback, state, icon and submenu. Like all menu items,
+// it's placed among its new siblings in the order the items were created.
+func (item *MenuItem) Reparent(newParent *MenuItem) error {
+	if !wt.isReady() {
+		return ErrTrayNotReadyYet
+	}
+	for p := newParent; p != nil; p = p.parentItem() {
+		if p == item {
+			return fmt.Errorf("cannot move %s into its own submenu", item)
+		}
+	}
+	oldParent := item.parentItem()
+	oldParentId := item.parentId()
+	visible := wt.getVisibleItemIndex(oldParentId, item.id) != -1
+	if visible {
+		// RemoveMenu keeps the submenu, unlike DeleteMenu
+		if err := wt.hideMenuItem(item.id, oldParentId); err != nil {
+			return fmt.Errorf("failed to remove menu item from its menu: %w", err)
+		}
+	}
+	item.mu.Lock()
+	item.parent = newParent
+	item.mu.Unlock()
+	// Like Remove, turn the old parent back into a plain item if the submenu is now empty
+	if oldParent != nil && !oldParent.hasChildren() {
+		if err := wt.removeSubMenu(oldParent.id, oldParent.parentId()); err != nil {
+			return fmt.Errorf("failed to remove empty submenu: %w", err)
+		}
+	}
+	if !visible {
+		return nil
+	}
+	if err := item.apply(); err != nil {
+		return fmt.Errorf("failed to add menu item to its new menu: %w", err)
+	}
+	return nil
+}
+
 // Set the icon of a menu item.
 // iconBytes should be the content of .ico image.
 func (item *MenuItem) SetIcon(iconBytes []byte) error {
@@ -1146,19 +2656,25 @@ func (item *MenuItem) SetIcon(iconBytes []byte) error {
 		return fmt.Errorf("failed to load icon: %w", err)
 	}
 
-	h, err = iconToBitmap(h)
+	bitmap, err := iconToBitmap(h)
 	if err != nil {
 		return fmt.Errorf("failed to convert icon to bitmap: %w", err)
 	}
-	wt.muMenuItemIcons.Lock()
-	wt.menuItemIcons[uint32(item.id)] = h
-	wt.muMenuItemIcons.Unlock()
+	return item.setIconBitmap(bitmap, func() (windows.Handle, error) { return iconToBitmap(h) })
+}
 
-	err = wt.addOrUpdateMenuItem(uint32(item.id), item.parentId(), item.title, item.disabled, item.checked)
+// Set the icon of a menu item to the icon at index in an executable or DLL.
+func (item *MenuItem) SetIconFromExecutable(exePath string, index int) error {
+	h, err := wt.loadExecutableIcon(exePath, index)
 	if err != nil {
-		return fmt.Errorf("failed to update menu item: %w", err)
+		return fmt.Errorf("failed to extract icon: %w", err)
 	}
-	return nil
+
+	bitmap, err := iconToBitmap(h)
+	if err != nil {
+		return fmt.Errorf("failed to convert icon to bitmap: %w", err)
+	}
+	return item.setIconBitmap(bitmap, func() (windows.Handle, error) { return iconToBitmap(h) })
 }
 
 // Set the icon of a menu item from a file path.
@@ -1169,55 +2685,138 @@ func (item *MenuItem) SetIconFromFilePath(iconFilePath string) error {
 		return fmt.Errorf("failed to load icon: %w", err)
 	}
 
-	h, err = iconToBitmap(h)
+	bitmap, err := iconToBitmap(h)
 	if err != nil {
 		return fmt.Errorf("failed to convert icon to bitmap: %w", err)
 	}
-	wt.muMenuItemIcons.Lock()
-	wt.menuItemIcons[uint32(item.id)] = h
-	wt.muMenuItemIcons.Unlock()
-
-	err = wt.addOrUpdateMenuItem(uint32(item.id), item.parentId(), item.title, item.disabled, item.checked)
-	if err != nil {
-		return fmt.Errorf("failed to update menu item: %w", err)
-	}
-	return nil
+	return item.setIconBitmap(bitmap, func() (windows.Handle, error) { return iconToBitmap(h) })
 }
 
 // Set the tooltip to display on mouse hover of the tray icon.
+// Lines may be separated with "\n". The tooltip is truncated if it is longer
+// than 127 UTF-16 characters.
 func SetTooltip(tooltip string) error {
+	return setTooltip(tooltipText(tooltip))
+}
+
+// Return the tooltip currently set, after truncation, with lines separated by "\n".
+// It's empty before Register.
+func Tooltip() string {
+	wt.muNID.RLock()
+	defer wt.muNID.RUnlock()
+	if wt.nid == nil {
+		return ""
+	}
+	// The tip is null-terminated, anything after the terminator is left over from longer tips
+	return strings.ReplaceAll(windows.UTF16ToString(wt.nid.Tip[:]), "\r\n", "\n")
+}
+
+// Set the tooltip to display on mouse hover of the tray icon, one line per argument.
+// The tooltip is truncated if it is longer than 127 UTF-16 characters.
+func SetTooltipLines(lines ...string) error {
+	return setTooltip(strings.Join(lines, "\r\n"))
+}
+
+// Set a function computing the tooltip each time it's about to be shown,
+// e.g. to show up-to-date statistics without updating the tooltip all the time.
+// The function runs on the message loop thread and should return promptly.
+// Pass nil to keep the tooltip set with SetTooltip.
+func SetTooltipFunc(f func() string) {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	tooltipFunc = f
+}
+
+// Apply the tooltip computed by the function set with SetTooltipFunc, if any.
+func (t *winTray) refreshTooltip() {
+	callbacksLock.RLock()
+	f := tooltipFunc
+	callbacksLock.RUnlock()
+	if f == nil {
+		return
+	}
+	if err := setTooltip(tooltipText(f())); err != nil {
+		logf("systray error: failed to refresh tooltip: %s\n", err)
+	}
+}
+
+// Apply the tooltip to the tray icon.
+func setTooltip(tooltip string) error {
 	if !wt.isReady() {
 		return ErrTrayNotReadyYet
 	}
+	if quitting.Load() {
+		return ErrTrayQuitting
+	}
 	const NIF_TIP = 0x00000004
-	b, err := windows.UTF16FromString(tooltip)
+	wt.muNID.Lock()
+	defer wt.muNID.Unlock()
+	err := wt.nid.setTip(tooltip)
 	if err != nil {
 		return err
 	}
-	wt.muNID.Lock()
-	defer wt.muNID.Unlock()
-	copy(wt.nid.Tip[:], b[:])
 	wt.nid.Flags |= NIF_TIP
 	wt.nid.Size = uint32(unsafe.Sizeof(*wt.nid))
-	err = wt.nid.modify()
+	err = wt.modifyIcon()
 	if err != nil {
 		return fmt.Errorf("failed to set tooltip: %w", err)
 	}
 	return nil
 }
 
+// Normalize the line breaks in a tooltip.
+func tooltipText(tooltip string) string {
+	lines := strings.Split(tooltip, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// Add or update a menu item with a consistent snapshot of its properties.
+func (item *MenuItem) apply() error {
+	item.mu.RLock()
+	hidden := item.hidden
+	item.mu.RUnlock()
+	if hidden {
+		// The changes are applied when the item is shown again
+		return nil
+	}
+	if item.separator {
+		return wt.addSeparatorMenuItem(item.id, item.parentId())
+	}
+	item.mu.RLock()
+	title, disabled, checked, radio := item.title, item.disabled, item.checked, item.radio
+	if n := int(maxMenuItemLength.Load()); n > 0 {
+		if u := utf16.Encode([]rune(title)); len(u) > n {
+			title = string(utf16.Decode(truncateUTF16(u, n)))
+		}
+	}
+	if !item.mnemonic {
+		title = strings.ReplaceAll(title, "&", "&&")
+	}
+	if item.hotkeyText != "" {
+		// Text after a tab is right-aligned like an accelerator
+		title += "\t" + item.hotkeyText
+	}
+	// Grayed items are shown as disabled, their clicks are caught in showMenu
+	disabled = disabled || item.grayed
+	item.mu.RUnlock()
+	return wt.addOrUpdateMenuItem(uint32(item.id), item.parentId(), title, disabled, checked, radio)
+}
+
 // Add or update a menu item.
 func addOrUpdateMenuItem(item *MenuItem) {
-	err := wt.addOrUpdateMenuItem(uint32(item.id), item.parentId(), item.title, item.disabled, item.checked)
+	err := item.apply()
 	if err != nil {
-		log.Printf("systray error: unable to add or update menu item: %s\n", err)
+		logf("systray error: unable to add or update menu item: %s\n", err)
 	}
 }
 
-// Add a separator to the menu.
-func addSeparator(id uint32, parent uint32) {
-	err := wt.addSeparatorMenuItem(id, parent)
-	if err != nil {
-		log.Printf("systray error: unable to add separator: %s\n", err)
-	}
+// Add a separator to the submenu of parent, or to the menu if parent is nil.
+func addSeparator(parent *MenuItem) *MenuItem {
+	item := newMenuItem("", parent)
+	item.separator = true
+	item.update()
+	return item
 }
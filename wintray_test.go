@@ -0,0 +1,365 @@
+//go:build windows
+
+package wintray
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Register the tray once for all tests, in headless mode so that no icon shows up.
+// The message loop runs on the main thread, like in applications.
+func TestMain(m *testing.M) {
+	if err := SetHeadless(true); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// Keep the menus in memory so that the tests can check their contents
+	wt.api = testMenus
+	// The tests check the errors they expect, so don't clutter the output with them
+	SetLogger(log.New(io.Discard, "", 0))
+	if err := Register(nil, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := make(chan int, 1)
+	go func() {
+		code <- m.Run()
+		Quit()
+	}()
+	nativeLoop()
+	os.Exit(<-code)
+}
+
+var pGetObjectType = g32.NewProc("GetObjectType")
+
+// Return whether a GDI object still exists, i.e. hasn't been deleted.
+func gdiObjectExists(h windows.Handle) bool {
+	res, _, _ := pGetObjectType.Call(uintptr(h))
+	return res != 0
+}
+
+// Handle a synthesized message on the message loop thread as if it was sent to the tray window.
+func injectMessage(t *testing.T, message uint32, wParam, lParam uintptr) uintptr {
+	t.Helper()
+	var res uintptr
+	err := wt.runOnLoop(func() error {
+		res = wt.wndProc(wt.window, message, wParam, lParam)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// Return the lParam of a tray icon message reporting the event, as sent with NOTIFYICON_VERSION_4.
+func iconEvent(event uintptr) uintptr {
+	return event | uintptr(iconID.Load())<<16
+}
+
+// Wait for a value on ch, failing the test if none arrives within a few seconds.
+func receive(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// Wait until cond returns true, failing the test if it doesn't within a few seconds.
+func waitFor(t *testing.T, cond func() bool, what string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Return the content of an .ico file with a single 32-bit image of size pixels,
+// filled with color given as 0xAARRGGBB.
+func testIcon(size int, color uint32) []byte {
+	const headerSize = 6 + 16 + 40
+	pixels := size * size * 4
+	// Rows of the AND mask are padded to 32 bits
+	mask := (size + 31) / 32 * 4 * size
+	data := make([]byte, headerSize+pixels+mask)
+	le := binary.LittleEndian
+	// ICONDIR
+	le.PutUint16(data[2:], 1) // type: icon
+	le.PutUint16(data[4:], 1) // count
+	// ICONDIRENTRY, where 0 means 256
+	data[6] = byte(size)
+	data[7] = byte(size)
+	le.PutUint16(data[10:], 1)  // planes
+	le.PutUint16(data[12:], 32) // bit count
+	le.PutUint32(data[14:], uint32(len(data)-22))
+	le.PutUint32(data[18:], 22)
+	// BITMAPINFOHEADER, whose height covers the color image and the mask
+	le.PutUint32(data[22:], 40)
+	le.PutUint32(data[26:], uint32(size))
+	le.PutUint32(data[30:], uint32(size*2))
+	le.PutUint16(data[34:], 1)
+	le.PutUint16(data[36:], 32)
+	le.PutUint32(data[42:], uint32(pixels+mask))
+	for i := headerSize; i < headerSize+pixels; i += 4 {
+		le.PutUint32(data[i:], color)
+	}
+	return data
+}
+
+// Fail the test if a value arrives on ch within a short time.
+func expectNothing(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+		t.Fatalf("unexpected %s", what)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCommandCallsCallback(t *testing.T) {
+	const WM_COMMAND = 0x0111
+	item := AddMenuItem("Item")
+	defer item.Remove()
+	other := AddMenuItem("Other")
+	defer other.Remove()
+	clicked := make(chan struct{}, 1)
+	item.SetCallback(func() { clicked <- struct{}{} })
+	otherClicked := make(chan struct{}, 1)
+	other.SetCallback(func() { otherClicked <- struct{}{} })
+
+	injectMessage(t, WM_COMMAND, uintptr(item.id), 0)
+	receive(t, clicked, "callback of the chosen item")
+	expectNothing(t, otherClicked, "call of another item's callback")
+}
+
+func TestCommandCallsCallbackWithModifiers(t *testing.T) {
+	const WM_COMMAND = 0x0111
+	item := AddMenuItem("Item")
+	defer item.Remove()
+	clicked := make(chan struct{}, 1)
+	item.SetCallback(func() { t.Error("plain callback called instead of the one receiving modifiers") })
+	item.SetCallbackMods(func(mods Modifiers) { clicked <- struct{}{} })
+
+	injectMessage(t, WM_COMMAND, uintptr(item.id), 0)
+	receive(t, clicked, "callback receiving modifiers")
+}
+
+func TestCommandIgnoredWhileNotInteractive(t *testing.T) {
+	const WM_COMMAND = 0x0111
+	item := AddMenuItem("Item")
+	defer item.Remove()
+	clicked := make(chan struct{}, 1)
+	item.SetCallback(func() { clicked <- struct{}{} })
+
+	SetInteractive(false)
+	defer SetInteractive(true)
+	injectMessage(t, WM_COMMAND, uintptr(item.id), 0)
+	expectNothing(t, clicked, "callback call while not interactive")
+}
+
+func TestTaskbarCreatedAddsIconAgain(t *testing.T) {
+	const (
+		NIM_ADD    = 0x00000000
+		NIM_DELETE = 0x00000002
+	)
+	added := make(chan struct{}, 1)
+	OnIconAdded(func() { added <- struct{}{} })
+	defer OnIconAdded(nil)
+
+	resetHeadlessHistory()
+	injectMessage(t, wt.wmTaskbarCreated, 0, 0)
+	if n := notifyIconCalls(NIM_DELETE); n != 1 {
+		t.Errorf("got %d NIM_DELETE calls, want 1", n)
+	}
+	if n := notifyIconCalls(NIM_ADD); n != 1 {
+		t.Errorf("got %d NIM_ADD calls, want 1", n)
+	}
+	receive(t, added, "OnIconAdded callback")
+}
+
+func TestResetMenuRemovesItems(t *testing.T) {
+	parent := AddMenuItem("Parent")
+	parent.AddSubMenuItem("Child")
+	// The most recently created item must go too
+	AddMenuItem("Last")
+
+	ResetMenu()
+	menuItemsLock.RLock()
+	n := len(menuItems)
+	menuItemsLock.RUnlock()
+	if n != 0 {
+		t.Fatalf("%d menu items left after ResetMenu", n)
+	}
+	if parent.HasSubMenu() {
+		t.Fatal("submenu left after ResetMenu")
+	}
+}
+
+func TestResetMenuFreesIcons(t *testing.T) {
+	item := AddMenuItem("Item")
+	if err := item.SetColorSwatch(255, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := item.SetBadge(true); err != nil {
+		t.Fatal(err)
+	}
+	item.mu.RLock()
+	icon, badgeIcon := item.icon, item.badgeIcon
+	item.mu.RUnlock()
+
+	ResetMenu()
+	wt.muMenuItemIcons.RLock()
+	n := len(wt.menuItemIcons)
+	wt.muMenuItemIcons.RUnlock()
+	if n != 0 {
+		t.Errorf("%d menu item icons left after ResetMenu", n)
+	}
+	if gdiObjectExists(icon) || gdiObjectExists(badgeIcon) {
+		t.Error("bitmaps of the icon weren't deleted")
+	}
+}
+
+func TestMenuItemConcurrentAccess(t *testing.T) {
+	root := resetMenu(t)
+	item := AddMenuItem("Item")
+
+	// Run with -race to catch unsynchronized access to the fields
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				item.SetTitle(fmt.Sprintf("Item %d.%d", i, j))
+				_ = item.Title()
+				_ = item.String()
+				item.ToggleChecked()
+				item.SetCallback(func() {})
+				if j%2 == 0 {
+					item.Disable()
+				} else {
+					item.Enable()
+				}
+				_ = item.Disabled()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	checkMenu(t, root, nil, item)
+	// The last update wins in the menu too
+	item.SetTitle("Final")
+	if title := testMenus.item(t, root, item.id).Title; title != item.Title() {
+		t.Errorf("menu shows title %q, want %q", title, item.Title())
+	}
+}
+
+func TestDestroyRunsOnExit(t *testing.T) {
+	const (
+		WM_DESTROY  = 0x0002
+		WM_QUIT     = 0x0012
+		PM_NOREMOVE = 0x0000
+		NIM_DELETE  = 0x00000002
+	)
+	exited := make(chan struct{}, 1)
+	systrayExitLock.Lock()
+	systrayExit = func() {
+		select {
+		case <-Done():
+			t.Error("Done channel closed before onExit ran")
+		default:
+		}
+		exited <- struct{}{}
+	}
+	systrayExitLock.Unlock()
+	OnQueryEndSession(func() bool {
+		t.Error("WM_DESTROY called the OnQueryEndSession callback")
+		return true
+	})
+	defer func() {
+		// Undo the exit so that the other tests keep a working tray
+		OnQueryEndSession(nil)
+		systrayExitLock.Lock()
+		systrayExit = nil
+		systrayExitStarted = false
+		systrayExitOnce = sync.Once{}
+		systrayExitLock.Unlock()
+		doneCh = make(chan struct{})
+		doneOnce = sync.Once{}
+		injectMessage(t, wt.wmTaskbarCreated, 0, 0)
+	}()
+
+	// WM_DESTROY posts WM_QUIT to the calling thread, so use a thread of our own
+	// rather than the one running the message loop of the other tests
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	resetHeadlessHistory()
+	wt.wndProc(wt.window, WM_DESTROY, 0, 0)
+	receive(t, exited, "onExit callback")
+	if n := notifyIconCalls(NIM_DELETE); n != 1 {
+		t.Errorf("got %d NIM_DELETE calls, want 1", n)
+	}
+	select {
+	case <-Done():
+		t.Fatal("Done channel closed while the message loop is still running")
+	default:
+	}
+
+	m := &msg{}
+	res, _, _ := pPeekMessage.Call(uintptr(unsafe.Pointer(m)), 0, WM_QUIT, WM_QUIT, PM_NOREMOVE)
+	if res == 0 {
+		t.Fatal("WM_DESTROY didn't post WM_QUIT")
+	}
+	// The loop of this thread ends on WM_QUIT
+	nativeLoop()
+	select {
+	case <-Done():
+	default:
+		t.Error("Done channel not closed once the message loop exited")
+	}
+}
+
+func TestSyncMenuDispatch(t *testing.T) {
+	item := AddMenuItem("Item")
+	defer item.Remove()
+	clicked := make(chan struct{}, 1)
+	item.SetCallback(func() { clicked <- struct{}{} })
+	errFailed := errors.New("failed")
+
+	// TrackPopupMenu returns the chosen item
+	if err := wt.menuResult(uintptr(item.id), nil, true); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, clicked, "callback of the returned item")
+	// Zero means that nothing was chosen, not a failure
+	if err := wt.menuResult(0, errFailed, true); err != nil {
+		t.Errorf("dismissed menu returned error %v", err)
+	}
+	expectNothing(t, clicked, "callback call for a dismissed menu")
+
+	// Without TPM_RETURNCMD, the item comes as WM_COMMAND and zero means failure
+	if err := wt.menuResult(1, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, clicked, "callback call without WM_COMMAND")
+	if err := wt.menuResult(0, errFailed, false); err != errFailed {
+		t.Errorf("got error %v, want %v", err, errFailed)
+	}
+}